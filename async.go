@@ -0,0 +1,168 @@
+package urkeltrie
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// CommitResult is the outcome of the asynchronous commit.
+type CommitResult struct {
+	Version uint64
+	Hash    []byte
+	Err     error
+}
+
+// commitQueue tracks asynchronous commits. Commits are written one after another in the order
+// they were scheduled, the tree waits for all of them before it writes to the store itself.
+type commitQueue struct {
+	mu sync.Mutex
+	// last is closed when the last scheduled commit is finished
+	last chan struct{}
+	// err is the error of the first failed commit, every following commit fails with it
+	err error
+}
+
+// schedule returns a channel of the previous commit and a channel that must be closed when the new commit is finished.
+func (q *commitQueue) schedule() (<-chan struct{}, chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	prev, done := q.last, make(chan struct{})
+	q.last = done
+	return prev, done
+}
+
+func (q *commitQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *commitQueue) failed() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// wait blocks until all scheduled commits are finished and returns the error of the failed commit.
+func (q *commitQueue) wait() error {
+	q.mu.Lock()
+	last := q.last
+	q.mu.Unlock()
+	if last != nil {
+		<-last
+	}
+	return q.failed()
+}
+
+// reset forgets the error, must be called after all commits are finished.
+func (q *commitQueue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.err = nil
+}
+
+// CommitAsync freezes dirty nodes of the tree and writes them to the store in the background.
+// Returned channel receives the result once the version is durable. Tree can be modified and committed
+// again right away, nodes that are not written yet are pinned in the store and are read from memory.
+//
+// Versions are persisted in the order they were committed with the same guarantees as Commit.
+// If a commit fails every following commit fails with the same error, and the tree must be reloaded
+// with LoadLatest or LoadVersion. Other methods that write to the store or read versions wait
+// for asynchronous commits. If the backend doesn't implement store.NodePinner tree is committed synchronously.
+func (t *Tree) CommitAsync() <-chan CommitResult {
+	rst := make(chan CommitResult, 1)
+	pinner, ok := t.store.(store.NodePinner)
+	if !ok || t.root == nil {
+		err := t.Commit()
+		rst <- CommitResult{Version: t.version, Hash: t.Hash(), Err: err}
+		return rst
+	}
+	if err := t.commits.failed(); err != nil {
+		rst <- CommitResult{Err: err}
+		return rst
+	}
+	// operation log is truncated by the next synchronous commit
+	if err := t.logCommit(t.version + 1); err != nil {
+		rst <- CommitResult{Err: err}
+		return rst
+	}
+	start := time.Now()
+	root := t.root
+	nodes := countDirty(root)
+	root.Allocate(t.store)
+	hash := root.Hash()
+	pinned := pinDirty(pinner, root, nil)
+	t.version++
+	version := t.version
+	prev, done := t.commits.schedule()
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		err := t.commits.failed()
+		if err == nil {
+			err = root.Commit(t.store)
+		}
+		if err == nil {
+			err = writeVersion(t.store, version, root, nil)
+		}
+		for _, pos := range pinned {
+			pinner.UnpinNode(uint32(pos>>32), uint32(pos))
+		}
+		if err == nil {
+			t.metrics.written.Add(nodes)
+			t.metrics.lastWritten.Set(nodes)
+			t.metrics.commits.Since(start)
+			err = pruneRetained(t.store, version)
+		}
+		if err != nil {
+			t.commits.fail(err)
+		}
+		rst <- CommitResult{Version: version, Hash: hash, Err: err}
+	}()
+	t.root = root.copy()
+	return rst
+}
+
+// waitCommits waits until asynchronous commits are finished and returns the error of the failed commit.
+func (t *Tree) waitCommits() error {
+	if t.commits == nil {
+		return nil
+	}
+	return t.commits.wait()
+}
+
+// pinDirty pins records of the dirty nodes in the subtree and returns their positions.
+// Nodes must be allocated.
+func pinDirty(p store.NodePinner, n node, pinned []uint64) []uint64 {
+	switch n := n.(type) {
+	case *inner:
+		if n == nil || !n.dirty {
+			return pinned
+		}
+		p.PinNode(n.idx, n.pos, n.record())
+		pinned = append(pinned, position(n.idx, n.pos))
+		pinned = pinDirty(p, n.left, pinned)
+		return pinDirty(p, n.right, pinned)
+	case *leaf:
+		if n.dirty {
+			p.PinNode(n.idx, n.pos, n.record())
+			pinned = append(pinned, position(n.idx, n.pos))
+		}
+	}
+	return pinned
+}
+
+// resetCommits waits for asynchronous commits and forgets the error of the failed commit.
+func (t *Tree) resetCommits() {
+	if t.commits == nil {
+		return
+	}
+	_ = t.commits.wait()
+	t.commits.reset()
+}
@@ -0,0 +1,111 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitAsync(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-commit-async-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 4096
+	conf.ValueChunkSize = 100
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	plain := setupFullTree(t, 0)
+
+	var (
+		results []<-chan CommitResult
+		hashes  [][]byte
+		keys    [][]byte
+		values  = map[string][]byte{}
+	)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 20; j++ {
+			key, value := make([]byte, 10), make([]byte, 20)
+			rand.Read(key)
+			rand.Read(value)
+			keys = append(keys, key)
+			values[string(key)] = value
+			require.NoError(t, tree.Put(key, value))
+			require.NoError(t, plain.Put(key, value))
+		}
+		// chunks are written before the pending commit is finished
+		key, large := make([]byte, 10), make([]byte, 250)
+		rand.Read(key)
+		rand.Read(large)
+		values[string(key)] = large
+		require.NoError(t, tree.PutReader(key, bytes.NewReader(large), int64(len(large))))
+		require.NoError(t, plain.Put(key, large))
+		// overwrite and delete values that may be pinned
+		require.NoError(t, tree.Put(keys[i], keys[i]))
+		require.NoError(t, plain.Put(keys[i], keys[i]))
+		values[string(keys[i])] = keys[i]
+		require.NoError(t, tree.Delete(keys[i+1]))
+		require.NoError(t, plain.Delete(keys[i+1]))
+		delete(values, string(keys[i+1]))
+
+		results = append(results, tree.CommitAsync())
+		require.NoError(t, plain.Commit())
+		require.Equal(t, plain.Hash(), tree.Hash())
+		hashes = append(hashes, append([]byte{}, plain.Hash()...))
+		for key, value := range values {
+			got, err := tree.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, value, got)
+		}
+	}
+	for i, rst := range results {
+		result := <-rst
+		require.NoError(t, result.Err)
+		require.Equal(t, uint64(i+1), result.Version)
+		require.Equal(t, hashes[i], result.Hash)
+	}
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	require.False(t, st.Recovery().Discarded())
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(len(hashes)), tree.Version())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	for i, hash := range hashes {
+		snap, err := tree.VersionSnapshot(uint64(i + 1))
+		require.NoError(t, err)
+		require.Equal(t, hash, snap.Hash(), "version %d", i+1)
+	}
+	for key, value := range values {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+}
+
+func TestCommitAsyncSync(t *testing.T) {
+	tree := setupFullTree(t, 0)
+	for i := 0; i < 3; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		require.NoError(t, tree.Put(key, key))
+		rst := tree.CommitAsync()
+		require.NoError(t, tree.Put(key, []byte("value")))
+		// sync commit waits for the asynchronous one
+		require.NoError(t, tree.Commit())
+		result := <-rst
+		require.NoError(t, result.Err)
+		require.Equal(t, uint64(2*i+1), result.Version)
+		require.Equal(t, uint64(2*i+2), tree.Version())
+	}
+}
@@ -0,0 +1,154 @@
+package urkeltrie
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// ErrAuthentication returned if encrypted value was modified.
+var ErrAuthentication = errors.New("value authentication failed")
+
+// Encoded body starts with a header. Lower bits of the header are the id of the codec that was used
+// for the value, zero if value is not encoded. High bit is set if preimage and value are encrypted.
+//
+//	not encrypted: header | preimage | value
+//	encrypted:     header | nonce | seal(preimage | value)
+//
+// Key of the leaf is used as additional data, so that the body can't be moved to another leaf.
+// Body that is not encoded is preimage | value.
+const encryptedFlag = 0x80
+
+// inline leaf record is key | encoded flag | preimage length (uint16) | body length (uint16) | body | crc
+const inlineHeaderSize = size + 1 + 2 + 2
+
+// encodeBody returns body with preimage and value before encryption and true if body has a header.
+// If encryption is disabled value is encoded only if codec makes it smaller.
+func encodeBody(codec store.Codec, encrypt bool, preimage, value []byte) ([]byte, bool) {
+	if codec != nil {
+		body := make([]byte, 1+len(preimage), 1+len(preimage)+len(value))
+		body[0] = codec.ID()
+		copy(body[1:], preimage)
+		body = codec.Encode(body, value)
+		if encrypt || len(body) < len(preimage)+len(value) {
+			if encrypt {
+				body[0] |= encryptedFlag
+			}
+			return body, true
+		}
+	}
+	if encrypt {
+		body := make([]byte, 1+len(preimage)+len(value))
+		body[0] = encryptedFlag
+		copy(body[1:], preimage)
+		copy(body[1+len(preimage):], value)
+		return body, true
+	}
+	body := make([]byte, len(preimage)+len(value))
+	copy(body, preimage)
+	copy(body[len(preimage):], value)
+	return body, false
+}
+
+// sealedSize returns size of the body after sealBody.
+func sealedSize(aead cipher.AEAD, body []byte, encoded bool) int {
+	if !encoded || body[0]&encryptedFlag == 0 {
+		return len(body)
+	}
+	return len(body) + aead.NonceSize() + aead.Overhead()
+}
+
+// sealBody encrypts the body if it was prepared for encryption.
+func sealBody(aead cipher.AEAD, body []byte, encoded bool, ad []byte) ([]byte, error) {
+	if !encoded || body[0]&encryptedFlag == 0 {
+		return body, nil
+	}
+	if aead == nil {
+		return nil, errors.New("encryption key is not configured")
+	}
+	sealed := make([]byte, 1+aead.NonceSize(), sealedSize(aead, body, encoded)+4)
+	sealed[0] = body[0]
+	if _, err := rand.Read(sealed[1:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(sealed, sealed[1:], body[1:], ad), nil
+}
+
+// decodeBody returns preimage and value from the body without crc.
+func decodeBody(aead cipher.AEAD, body []byte, encoded bool, ad []byte, keyLength int) ([]byte, []byte, error) {
+	if !encoded {
+		if len(body) < keyLength {
+			return nil, nil, errors.New("value body is shorter than preimage")
+		}
+		return body[:keyLength], body[keyLength:], nil
+	}
+	header, data := body[0], body[1:]
+	if header&encryptedFlag > 0 {
+		if aead == nil {
+			return nil, nil, errors.New("value is encrypted, but encryption key is not configured")
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, nil, ErrAuthentication
+		}
+		plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrAuthentication, err)
+		}
+		data = plain
+	}
+	if len(data) < keyLength {
+		return nil, nil, errors.New("value body is shorter than preimage")
+	}
+	preimage, value := data[:keyLength], data[keyLength:]
+	if id := header &^ encryptedFlag; id != 0 {
+		codec, exist := store.GetCodec(id)
+		if !exist {
+			return nil, nil, fmt.Errorf("unknown codec %d", id)
+		}
+		decoded, err := codec.Decode(nil, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		value = decoded
+	}
+	return preimage, value, nil
+}
+
+// encodeBody prepares body for the commit and selects type of the record.
+func (l *leaf) encodeBody(s store.Backend) {
+	codec, aead := store.ValueCodec(s), store.ValueCipher(s)
+	if chunk := store.ValueChunkSize(s); chunk > 0 && (l.written || len(l.value) > chunk) {
+		l.encodeChunked(aead, chunk)
+		return
+	}
+	limit := store.InlineValueSize(s)
+	if store.DedupIndex(s) != nil && (limit == 0 || len(l.preimage)+len(l.value) > limit) &&
+		len(l.preimage) <= maxSharedPreimage {
+		l.encodeShared(aead)
+		return
+	}
+	l.body, l.encoded = encodeBody(codec, aead != nil, l.preimage, l.value)
+	l.bodySize = sealedSize(aead, l.body, l.encoded)
+	switch {
+	case limit > 0 && l.bodySize <= limit:
+		l.ntype = inlineLeafNode
+	case l.encoded:
+		l.ntype = encodedLeafNode
+	default:
+		l.ntype = leafNode
+	}
+}
+
+// decodeBody sets preimage and value from the body without crc.
+func (l *leaf) decodeBody(s store.Backend, body []byte) error {
+	preimage, value, err := decodeBody(store.ValueCipher(s), body, l.encoded, l.key[:], l.keyLength)
+	if err != nil {
+		return err
+	}
+	l.preimage, l.value = preimage, value
+	l.valueLength = len(value)
+	return nil
+}
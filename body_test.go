@@ -0,0 +1,204 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueEncryption(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-value-encryption-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	conf := store.DefaultConfig(tmp)
+	conf.EncryptionKey = key
+	conf.ValueCodec = store.Flate
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+
+	plain := setupFullTree(t, 0)
+	tree := NewTree(st)
+	keys := [][]byte{}
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		keys = append(keys, key)
+		require.NoError(t, tree.Put(key, compressibleValue(i)))
+		require.NoError(t, plain.Put(key, compressibleValue(i)))
+	}
+	require.NoError(t, tree.Commit())
+	require.NoError(t, plain.Commit())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.NoError(t, st.Close())
+
+	data, err := ioutil.ReadFile(filepath.Join(tmp, "value-0.udb"))
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.False(t, bytes.Contains(data, key))
+	}
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, compressibleValue(i), val)
+	}
+	require.NoError(t, st.Close())
+
+	conf.EncryptionKey = nil
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	_, err = tree.Get(keys[0])
+	require.Error(t, err)
+	require.NoError(t, st.Close())
+
+	conf.EncryptionKey = make([]byte, 32)
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	_, err = tree.Get(keys[0])
+	require.True(t, errors.Is(err, ErrAuthentication), "error: %v", err)
+}
+
+func TestValueTampered(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-value-tampered-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.EncryptionKey = make([]byte, 16)
+	rand.Read(conf.EncryptionKey)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	key := []byte("key")
+	require.NoError(t, tree.Put(key, []byte("value")))
+	require.NoError(t, tree.Commit())
+	require.NoError(t, st.Close())
+
+	// modify encrypted body and fix crc
+	path := filepath.Join(tmp, "value-0.udb")
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-5] ^= 0xff
+	putCrcSum32(data[len(data)-4:], data[:len(data)-4])
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	_, err = tree.Get(key)
+	require.True(t, errors.Is(err, ErrAuthentication), "error: %v", err)
+	require.False(t, errors.Is(err, ErrCRC))
+}
+
+func TestInvalidEncryptionKey(t *testing.T) {
+	conf := store.DefaultConfig("")
+	conf.EncryptionKey = make([]byte, 10)
+	_, err := store.Open(conf)
+	require.Error(t, err)
+}
+
+func TestInlineValues(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		conf func(*store.Config)
+	}{
+		{desc: "plain"},
+		{desc: "no read buffer", conf: func(conf *store.Config) {
+			conf.ReadBufferChunkSize = 0
+			conf.NodeCacheSize = 0
+		}},
+		{desc: "encrypted", conf: func(conf *store.Config) {
+			conf.EncryptionKey = make([]byte, 32)
+			conf.ValueCodec = store.Flate
+		}},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-inline-values-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			if tc.conf != nil {
+				tc.conf(&conf)
+			}
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			plain := setupFullTree(t, 0)
+			tree := NewTree(st)
+
+			// values written before inlining was enabled
+			keys, values := [][]byte{}, [][]byte{}
+			put := func(n, size int) {
+				for i := 0; i < n; i++ {
+					key := make([]byte, 10)
+					rand.Read(key)
+					value := make([]byte, size)
+					rand.Read(value)
+					keys, values = append(keys, key), append(values, value)
+					require.NoError(t, tree.Put(key, value))
+					require.NoError(t, plain.Put(key, value))
+				}
+				require.NoError(t, tree.Commit())
+				require.NoError(t, plain.Commit())
+			}
+			put(50, 20)
+			require.NoError(t, st.Close())
+
+			conf.InlineValueSize = 128
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			valueFile := filepath.Join(tmp, "value-0.udb")
+			before, err := os.Stat(valueFile)
+			require.NoError(t, err)
+
+			put(100, 20)
+			after, err := os.Stat(valueFile)
+			require.NoError(t, err)
+			require.Equal(t, before.Size(), after.Size())
+
+			put(10, 1000)
+			after, err = os.Stat(valueFile)
+			require.NoError(t, err)
+			require.Greater(t, after.Size(), before.Size())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			require.NoError(t, st.Close())
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			defer st.Close()
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			for i, key := range keys {
+				val, err := tree.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, values[i], val)
+			}
+		})
+	}
+}
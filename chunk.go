@@ -0,0 +1,338 @@
+package urkeltrie
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// Chunked leaf is written if the value is larger than the chunk size of the store. Every chunk is
+// a separate body in the value group, record stores the preimage and references to the chunks:
+//
+//	key | value size (uint64) | chunk size (uint32) | chunks (uint32) | flags | preimage size (uint32) | preimage | refs | crc
+//	ref: value idx | value pos | body size (uint32) | flags
+//
+// Chunk is encoded as described in body.go but without preimage, key and the index of the chunk are used
+// as additional data for encryption. Preimage is encoded in the same way as in the shared leaf.
+const (
+	chunkedHeaderSize = size + 8 + 4 + 4 + 1 + 4
+	chunkRefSize      = 4 + 4 + 4 + 1
+
+	chunkedPreimageEncoded = 1
+	chunkEncoded           = 1
+
+	// size of the record is read before crc is checked, larger record is considered corrupted
+	maxChunkedRecordSize = 1 << 30
+)
+
+type chunkRef struct {
+	idx, pos uint32
+	// size of the body without crc
+	size    int
+	encoded bool
+}
+
+// maxChunkedValueSize returns the size of the largest value that fits into the chunked record
+// with the preimage.
+func maxChunkedValueSize(preimageSize, chunkSize int) uint64 {
+	return uint64((maxChunkedRecordSize-chunkedSize(preimageSize, 0))/chunkRefSize) * uint64(chunkSize)
+}
+
+func chunkedSize(preimageSize, chunks int) int {
+	return chunkedHeaderSize + preimageSize + chunks*chunkRefSize + 4
+}
+
+// chunkAD returns additional data for the encryption of the chunk.
+func chunkAD(key [size]byte, i int) []byte {
+	ad := make([]byte, size+4)
+	copy(ad, key[:])
+	order.PutUint32(ad[size:], uint32(i))
+	return ad
+}
+
+// encodeChunked prepares preimage for the chunked record. Chunks are encoded and written on commit,
+// unless they were already written by writeChunks.
+func (l *leaf) encodeChunked(aead cipher.AEAD, chunkSize int) {
+	l.ntype = chunkedLeafNode
+	if !l.written {
+		l.chunkSize = chunkSize
+		l.valueSize = uint64(len(l.value))
+		l.chunks = make([]chunkRef, (len(l.value)+chunkSize-1)/chunkSize)
+	}
+	l.preimageBody, l.preimageEncoded = encodeBody(nil, aead != nil, l.preimage, nil)
+	l.preimageSize = sealedSize(aead, l.preimageBody, l.preimageEncoded)
+	l.body = nil
+}
+
+// sealChunks encodes and seals every chunk of the value, unless chunks were written by writeChunks,
+// and seals the preimage.
+func (l *leaf) sealChunks(s store.Backend) error {
+	aead := store.ValueCipher(s)
+	if !l.written {
+		l.chunkBodies = make([][]byte, len(l.chunks))
+		for i := range l.chunks {
+			start := i * l.chunkSize
+			end := start + l.chunkSize
+			if end > len(l.value) {
+				end = len(l.value)
+			}
+			body, ref, err := sealChunk(s, l.key, i, l.value[start:end])
+			if err != nil {
+				return err
+			}
+			l.chunkBodies[i], l.chunks[i] = body, ref
+		}
+	}
+	var err error
+	l.preimageBody, err = sealBody(aead, l.preimageBody, l.preimageEncoded, l.key[:])
+	return err
+}
+
+// placeChunks allocates offsets for the sealed chunks.
+func (l *leaf) placeChunks(s store.Backend) [][]byte {
+	for i, body := range l.chunkBodies {
+		l.chunks[i].idx, l.chunks[i].pos = s.ValueOffsetFor(len(body))
+	}
+	return l.chunkBodies
+}
+
+// sealChunk encodes and seals the chunk of the value and appends crc. Returned reference doesn't have an offset.
+func sealChunk(s store.Backend, key [size]byte, i int, chunk []byte) ([]byte, chunkRef, error) {
+	aead := store.ValueCipher(s)
+	body, encoded := encodeBody(store.ValueCodec(s), aead != nil, nil, chunk)
+	size := sealedSize(aead, body, encoded)
+	body, err := sealBody(aead, body, encoded, chunkAD(key, i))
+	if err != nil {
+		return nil, chunkRef{}, err
+	}
+	return appendCrc(body, size), chunkRef{size: size, encoded: encoded}, nil
+}
+
+// writeChunk seals the chunk of the value and writes it to the value group.
+func writeChunk(s store.Backend, key [size]byte, i int, chunk []byte) (chunkRef, error) {
+	body, ref, err := sealChunk(s, key, i, chunk)
+	if err != nil {
+		return chunkRef{}, err
+	}
+	ref.idx, ref.pos = s.ValueOffsetFor(len(body))
+	n, err := s.WriteValue(body)
+	if err != nil {
+		return chunkRef{}, err
+	}
+	if n != len(body) {
+		return chunkRef{}, errors.New("partial chunk write")
+	}
+	return ref, nil
+}
+
+// writeChunks reads the value of the size from r and writes it to the value group chunk by chunk,
+// so that only one chunk is kept in memory. Hash of the value is computed from the written chunks.
+// Chunks become durable with the next commit of the store.
+func (l *leaf) writeChunks(s store.Backend, r io.Reader, valueSize int64, chunkSize int) error {
+	var (
+		h   = hasher()
+		buf = make([]byte, chunkSize)
+	)
+	l.chunkSize = chunkSize
+	l.valueSize = uint64(valueSize)
+	// references are appended as chunks are read, size may be larger than the reader
+	l.chunks = nil
+	for i := 0; int64(i)*int64(chunkSize) < valueSize; i++ {
+		chunk := buf
+		if rest := valueSize - int64(i)*int64(chunkSize); rest < int64(chunkSize) {
+			chunk = buf[:rest]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("failed to read chunk %d of the value: %w", i, err)
+		}
+		h.Write(chunk)
+		ref, err := writeChunk(s, l.key, i, chunk)
+		if err != nil {
+			return err
+		}
+		l.chunks = append(l.chunks, ref)
+	}
+	// chunks are read from the value group before commit, e.g. by Get
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	var rst [size]byte
+	h.Sum(rst[:0])
+	l.hash = leafHash(l.key[:], rst[:])
+	l.written = true
+	return nil
+}
+
+func (l *leaf) marshalChunked(preimage []byte) []byte {
+	buf := make([]byte, l.Size())
+	copy(buf, l.key[:])
+	order.PutUint64(buf[32:], l.valueSize)
+	order.PutUint32(buf[40:], uint32(l.chunkSize))
+	order.PutUint32(buf[44:], uint32(len(l.chunks)))
+	if l.preimageEncoded {
+		buf[48] |= chunkedPreimageEncoded
+	}
+	order.PutUint32(buf[49:], uint32(len(preimage)))
+	copy(buf[chunkedHeaderSize:], preimage)
+	refs := buf[chunkedHeaderSize+len(preimage):]
+	for _, ref := range l.chunks {
+		order.PutUint32(refs, ref.idx)
+		order.PutUint32(refs[4:], ref.pos)
+		order.PutUint32(refs[8:], uint32(ref.size))
+		if ref.encoded {
+			refs[12] |= chunkEncoded
+		}
+		refs = refs[chunkRefSize:]
+	}
+	putCrcSum32(buf[len(buf)-4:], buf[:len(buf)-4])
+	return buf
+}
+
+// unmarshalChunked decodes the record without the preimage section.
+func (l *leaf) unmarshalChunked(buf []byte) error {
+	if crcSum32(buf[:len(buf)-4]) != order.Uint32(buf[len(buf)-4:]) {
+		return ErrCRC
+	}
+	copy(l.key[:], buf)
+	l.valueSize = order.Uint64(buf[32:])
+	l.chunkSize = int(order.Uint32(buf[40:]))
+	l.chunks = make([]chunkRef, order.Uint32(buf[44:]))
+	l.preimageEncoded = buf[48]&chunkedPreimageEncoded > 0
+	l.preimageSize = int(order.Uint32(buf[49:]))
+	refs := buf[chunkedHeaderSize+l.preimageSize:]
+	for i := range l.chunks {
+		l.chunks[i] = chunkRef{
+			idx:     order.Uint32(refs),
+			pos:     order.Uint32(refs[4:]),
+			size:    int(order.Uint32(refs[8:])),
+			encoded: refs[12]&chunkEncoded > 0,
+		}
+		refs = refs[chunkRefSize:]
+	}
+	if l.valueSize > uint64(len(l.chunks))*uint64(l.chunkSize) {
+		return fmt.Errorf("value of %d bytes doesn't fit into %d chunks", l.valueSize, len(l.chunks))
+	}
+	return nil
+}
+
+// readChunked reads the record from the tree group. Chunks of the value are not read,
+// they are loaded only if the value is requested, see syncValue.
+func (l *leaf) readChunked(s store.Backend) error {
+	if err := l.readChunkedRecord(s); err != nil {
+		return err
+	}
+	l.value, l.written = nil, true
+	return nil
+}
+
+// readChunkedRecord reads the record and decodes the preimage, chunks of the value are not read.
+func (l *leaf) readChunkedRecord(s store.Backend) error {
+	var recordSize int
+	err := store.ViewTree(s, l.idx, l.pos, chunkedHeaderSize, func(header []byte) error {
+		recordSize = chunkedSize(int(order.Uint32(header[49:])), int(order.Uint32(header[44:])))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	if recordSize > maxChunkedRecordSize {
+		return fmt.Errorf("%w: leaf node at %d:%d has size %d", ErrCRC, l.idx, l.pos, recordSize)
+	}
+	var section []byte
+	err = store.ViewTree(s, l.idx, l.pos, recordSize, func(buf []byte) error {
+		if err := l.unmarshalChunked(buf); err != nil {
+			return err
+		}
+		// preimage is retained by the leaf and can't point to the mapped memory
+		section = append([]byte{}, buf[chunkedHeaderSize:chunkedHeaderSize+l.preimageSize]...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	_, preimage, err := decodeBody(store.ValueCipher(s), section, l.preimageEncoded, l.key[:], 0)
+	if err != nil {
+		return fmt.Errorf("failed to decode preimage of the leaf at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	l.preimage, l.keyLength = preimage, len(preimage)
+	return nil
+}
+
+// readChunks reads every chunk of the value and returns the value.
+func (l *leaf) readChunks(s store.Backend) ([]byte, error) {
+	value := make([]byte, 0, l.valueSize)
+	err := l.eachChunk(s, func(_ int, chunk []byte) error {
+		value = append(value, chunk...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// hashChunks reads chunks of the value one by one and returns the hash of the value.
+func (l *leaf) hashChunks(s store.Backend) ([]byte, error) {
+	h := hasher()
+	err := l.eachChunk(s, func(_ int, chunk []byte) error {
+		h.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyChunks copies chunks of the value one by one from src to dst and replaces references.
+func (l *leaf) copyChunks(src, dst store.Backend) error {
+	chunks := make([]chunkRef, len(l.chunks))
+	err := l.eachChunk(src, func(i int, chunk []byte) error {
+		ref, err := writeChunk(dst, l.key, i, chunk)
+		chunks[i] = ref
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	l.chunks = chunks
+	return nil
+}
+
+// eachChunk reads chunks of the value in order, so that only one chunk is kept in memory.
+func (l *leaf) eachChunk(s store.Backend, f func(int, []byte) error) error {
+	var read uint64
+	for i := range l.chunks {
+		chunk, err := readChunk(s, l.key, l.chunks[i], i)
+		if err != nil {
+			return err
+		}
+		if len(chunk) > l.chunkSize {
+			return fmt.Errorf("chunk %d of the value is larger than %d bytes", i, l.chunkSize)
+		}
+		read += uint64(len(chunk))
+		if err := f(i, chunk); err != nil {
+			return err
+		}
+	}
+	if read != l.valueSize {
+		return errors.New("size of the chunks doesn't match size of the value")
+	}
+	return nil
+}
+
+// readChunk reads and decodes the chunk of the value.
+func readChunk(s store.Backend, key [size]byte, ref chunkRef, i int) ([]byte, error) {
+	body, err := readValue(s, ref.idx, ref.pos, ref.size)
+	if err != nil {
+		return nil, err
+	}
+	_, chunk, err := decodeBody(store.ValueCipher(s), body, ref.encoded, chunkAD(key, i), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode chunk at %d:%d. error %w", ref.idx, ref.pos, err)
+	}
+	return chunk, nil
+}
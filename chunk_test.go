@@ -0,0 +1,136 @@
+package urkeltrie
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedValues(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		conf func(*store.Config)
+	}{
+		{"plain", func(*store.Config) {}},
+		{"encoded", func(conf *store.Config) {
+			conf.ValueCodec = store.Flate
+			conf.EncryptionKey = make([]byte, 16)
+		}},
+		{"dedup", func(conf *store.Config) {
+			conf.DedupIndexSize = 100
+			conf.InlineValueSize = 64
+		}},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-chunked-values-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			conf.MaxFileSize = 4096
+			conf.ValueChunkSize = 1000
+			tc.conf(&conf)
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			tree := NewTree(st)
+			plain := setupFullTree(t, 0)
+
+			values := map[string][]byte{}
+			for _, lth := range []int{0, 10, 999, 1000, 1001, 3500} {
+				key := make([]byte, 10)
+				rand.Read(key)
+				value := make([]byte, lth)
+				rand.Read(value)
+				// compressible chunk
+				copy(value, make([]byte, lth/2))
+				values[string(key)] = value
+				require.NoError(t, tree.Put(key, value))
+				require.NoError(t, plain.Put(key, value))
+			}
+			require.NoError(t, tree.Commit())
+			require.NoError(t, plain.Commit())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			require.NoError(t, st.Close())
+
+			report, err := Verify(conf, 0, 0)
+			require.NoError(t, err)
+			require.True(t, report.OK(), "%v", report.Corrupted)
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			defer st.Close()
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			for key, value := range values {
+				got, err := tree.Get([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, value, got)
+			}
+
+			require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+			for key, value := range values {
+				got, err := tree.Get([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, value, got)
+			}
+		})
+	}
+}
+
+func TestChunkedValueLoadedOnRead(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-chunked-lazy-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.ValueChunkSize = 100
+	conf.InlineValueSize = 64
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	value := make([]byte, 1000)
+	rand.Read(value)
+	require.NoError(t, tree.Put([]byte("big"), value))
+	require.NoError(t, tree.Put([]byte("small"), []byte("small")))
+	require.NoError(t, tree.Commit())
+	require.NoError(t, st.Close())
+
+	// only chunks are stored in the value group
+	corruptFile(t, filepath.Join(tmp, "value-0.udb"), 0, func(data []byte) {
+		for i := range data {
+			data[i] ^= 0xff
+		}
+	})
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+
+	keys := 0
+	require.NoError(t, tree.Iterate(func(e Entry) bool {
+		_, err := e.Key()
+		require.NoError(t, err)
+		keys++
+		return false
+	}))
+	require.Equal(t, 2, keys)
+
+	_, err = tree.Get([]byte("big"))
+	require.Error(t, err)
+
+	require.NoError(t, tree.Delete([]byte("big")))
+	require.NoError(t, tree.Commit())
+	got, err := tree.Get([]byte("small"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("small"), got)
+}
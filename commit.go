@@ -0,0 +1,158 @@
+package urkeltrie
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// nodes are encoded and marshaled by a single goroutine if there are less of them
+const minParallelNodes = 64
+
+// collectDirty appends dirty nodes of the subtree in pre-order, the same order offsets are allocated in.
+func collectDirty(n node, nodes []node) []node {
+	switch n := n.(type) {
+	case *inner:
+		if n == nil || !n.dirty {
+			return nodes
+		}
+		nodes = append(nodes, n)
+		nodes = collectDirty(n.left, nodes)
+		return collectDirty(n.right, nodes)
+	case *leaf:
+		if n.dirty {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// parallel calls f for every index in [0, n) from several goroutines. Indexes are split into contiguous
+// ranges, nodes in pre-order are split into subtrees. Returns the first error.
+func parallel(n int, f func(int) error) error {
+	workers := runtime.GOMAXPROCS(0)
+	if n < minParallelNodes || workers == 1 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var (
+		wg   sync.WaitGroup
+		step = (n + workers - 1) / workers
+		errs = make([]error, workers)
+	)
+	for w := 0; w*step < n; w++ {
+		start, end := w*step, (w+1)*step
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				if err := f(i); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w, start, end)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateNodes encodes bodies of the dirty leaves concurrently and reserves offsets for dirty nodes in pre-order.
+func allocateNodes(s store.Backend, root *inner) {
+	nodes := collectDirty(root, nil)
+	_ = parallel(len(nodes), func(i int) error {
+		if l, ok := nodes[i].(*leaf); ok {
+			l.encodeBody(s)
+		}
+		return nil
+	})
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *inner:
+			n.idx, n.pos = s.TreeOffsetFor(n.Size())
+		case *leaf:
+			n.idx, n.pos = s.TreeOffsetFor(n.Size())
+		}
+	}
+}
+
+// commitNodes writes dirty nodes of the allocated subtree. Records of the inner nodes are marshaled and leaves are
+// sealed concurrently. Offsets in the value group are allocated sequentially, after that tree and value groups
+// are written, each in the order of allocated offsets. Groups are written concurrently if backend allows it.
+func commitNodes(s store.Backend, root *inner) error {
+	// records reference hashes of the children, they must be computed before the records are marshaled
+	_ = root.Hash()
+	nodes := collectDirty(root, nil)
+	records := make([][]byte, len(nodes))
+	err := parallel(len(nodes), func(i int) error {
+		switch n := nodes[i].(type) {
+		case *inner:
+			records[i] = n.Marshal()
+		case *leaf:
+			return n.seal(s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var values [][]byte
+	for i, n := range nodes {
+		if l, ok := n.(*leaf); ok {
+			values = append(values, l.place(s)...)
+			records[i] = l.marshalRecord()
+		}
+	}
+	if store.ConcurrentWrites(s) {
+		errc := make(chan error, 1)
+		go func() {
+			errc <- writeAll(s.WriteValue, values, "partial leaf body write")
+		}()
+		err = writeAll(s.WriteTree, records, "partial tree write")
+		if verr := <-errc; err == nil {
+			err = verr
+		}
+	} else if err = writeAll(s.WriteValue, values, "partial leaf body write"); err == nil {
+		err = writeAll(s.WriteTree, records, "partial tree write")
+	}
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *inner:
+			n.dirty = false
+		case *leaf:
+			n.committed()
+		}
+	}
+	return nil
+}
+
+// writeAll writes every buffer with write.
+func writeAll(write func([]byte) (int, error), bufs [][]byte, partial string) error {
+	for _, buf := range bufs {
+		n, err := write(buf)
+		if err != nil {
+			return err
+		}
+		if n != len(buf) {
+			return errors.New(partial)
+		}
+	}
+	return nil
+}
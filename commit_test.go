@@ -0,0 +1,72 @@
+package urkeltrie
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelCommit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-parallel-commit-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 1 << 14
+	conf.ValueCodec = store.Flate
+	conf.EncryptionKey = make([]byte, 16)
+	conf.InlineValueSize = 40
+	conf.DedupIndexSize = 100
+	conf.ValueChunkSize = 500
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	plain := setupFullTree(t, 0)
+
+	shared := make([]byte, 300)
+	rand.Read(shared)
+	values := map[string][]byte{}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 500; j++ {
+			key := make([]byte, 10)
+			rand.Read(key)
+			var value []byte
+			switch j % 4 {
+			case 0:
+				value = make([]byte, 10)
+			case 1:
+				value = make([]byte, 200)
+			case 2:
+				value = make([]byte, 1200)
+			case 3:
+				value = shared
+			}
+			if j%4 != 3 {
+				rand.Read(value)
+			}
+			values[string(key)] = value
+			require.NoError(t, tree.Put(key, value))
+			require.NoError(t, plain.Put(key, value))
+		}
+		require.NoError(t, tree.Commit())
+		require.NoError(t, plain.Commit())
+		require.Equal(t, plain.Hash(), tree.Hash())
+	}
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	for key, value := range values {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+}
@@ -0,0 +1,317 @@
+package urkeltrie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+var ErrDirtyTree = errors.New("tree has uncommitted changes")
+
+// CompactionOptions controls the pace of the compaction.
+type CompactionOptions struct {
+	// BytesPerSecond limits amount of data written to the new generation.
+	// Zero disables the limit.
+	BytesPerSecond int
+}
+
+// generational is a backend that can replace its files with a new generation.
+type generational interface {
+	store.Backend
+	NewGeneration() (*store.FileStore, error)
+	SwitchGeneration(*store.FileStore) error
+	DiscardGeneration(*store.FileStore) error
+}
+
+// Compaction copies nodes reachable from every version that is not pruned into
+// a new generation of files, leaving behind nodes from overwritten or deleted branches.
+// Nodes shared by several versions are copied once, which requires to keep in memory
+// 16 bytes per copied node.
+//
+// Run only reads committed data and can be executed in background while the tree keeps committing.
+// Switch to the new generation is done by Tree.FinishCompaction and requires exclusive access to the tree.
+type Compaction struct {
+	src  generational
+	dst  *store.FileStore
+	opts CompactionOptions
+
+	// last version that was copied into dst
+	copied uint64
+	// latest version when compaction was started
+	last uint64
+
+	// moved maps position of the node in the current generation to the position in the new generation
+	moved map[uint64]uint64
+
+	started time.Time
+	written int
+}
+
+// StartCompaction creates a new generation for all versions committed so far.
+func (t *Tree) StartCompaction(opts CompactionOptions) (*Compaction, error) {
+	src, ok := t.store.(generational)
+	if !ok {
+		return nil, fmt.Errorf("backend %T doesn't support compaction", t.store)
+	}
+	if err := t.waitCommits(); err != nil {
+		return nil, err
+	}
+	last, err := t.lastVersion()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := src.NewGeneration()
+	if err != nil {
+		return nil, err
+	}
+	return &Compaction{
+		src:   src,
+		dst:   dst,
+		opts:  opts,
+		last:  last,
+		moved: map[uint64]uint64{},
+	}, nil
+}
+
+// FinishCompaction copies versions that were committed after the compaction was started
+// and switches store to the new generation. Tree is reloaded from the new generation,
+// snapshots created before the switch must not be used after it.
+// If copy fails new generation is discarded. ErrDirtyTree is returned if tree has uncommitted changes,
+// in such case compaction can be finished after commit. Versions that were committed so far are copied
+// by the next Run.
+func (t *Tree) FinishCompaction(ctx context.Context, c *Compaction) error {
+	if err := t.waitCommits(); err != nil {
+		return err
+	}
+	last, err := t.lastVersion()
+	if err != nil {
+		return err
+	}
+	c.last = last
+	if t.root != nil && t.root.isDirty() {
+		return ErrDirtyTree
+	}
+	if err := c.Run(ctx); err != nil {
+		_ = c.Abort()
+		return err
+	}
+	if err := c.src.SwitchGeneration(c.dst); err != nil {
+		return err
+	}
+	return t.LoadVersion(t.version)
+}
+
+// Compact runs compaction to completion and switches tree to the new generation.
+func (t *Tree) Compact(ctx context.Context, opts CompactionOptions) error {
+	if t.root != nil && t.root.isDirty() {
+		return ErrDirtyTree
+	}
+	c, err := t.StartCompaction(opts)
+	if err != nil {
+		return err
+	}
+	if err := c.Run(ctx); err != nil {
+		_ = c.Abort()
+		return err
+	}
+	return t.FinishCompaction(ctx, c)
+}
+
+// lastVersion reads the latest committed version from the store.
+func (t *Tree) lastVersion() (uint64, error) {
+	buf := make([]byte, versionSize)
+	n, err := t.store.ReadLastVersion(buf)
+	if n == 0 {
+		// store without versions
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, _, err := unmarshalVersion(t.store, buf)
+	return version, err
+}
+
+// Abort removes files of the new generation.
+func (c *Compaction) Abort() error {
+	return c.src.DiscardGeneration(c.dst)
+}
+
+// Run copies all versions that were not copied yet.
+func (c *Compaction) Run(ctx context.Context) error {
+	if c.started.IsZero() {
+		c.started = time.Now()
+	}
+	buf := make([]byte, versionSize)
+	for version := c.copied + 1; version <= c.last; version++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.copyVersion(version, buf); err != nil {
+			return err
+		}
+		c.copied = version
+	}
+	return c.dst.Flush()
+}
+
+func (c *Compaction) copyVersion(version uint64, buf []byte) error {
+	n, err := c.src.ReadVersion(version, buf)
+	if errors.Is(err, store.ErrPruned) {
+		// keep versions at the same offsets. zeroed record fails crc check if pruned version is read.
+		for i := range buf {
+			buf[i] = 0
+		}
+		return c.writeVersion(buf)
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("incomplete version read")
+	}
+	_, root, err := unmarshalVersion(c.src, buf)
+	if err != nil {
+		return err
+	}
+	if err := c.copyInner(root); err != nil {
+		return fmt.Errorf("failed to copy version %d: %w", version, err)
+	}
+	if m, ok := c.src.(store.VersionMetaStore); ok {
+		meta, err := m.ReadVersionMeta(version)
+		if err != nil {
+			return err
+		}
+		if len(meta) > 0 {
+			if err := c.dst.WriteVersionMeta(meta); err != nil {
+				return err
+			}
+		}
+	}
+	marshalVersionTo(version, root, buf)
+	return c.writeVersion(buf)
+}
+
+func (c *Compaction) writeVersion(buf []byte) error {
+	n, err := c.dst.WriteVersion(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("incomplete version write")
+	}
+	return nil
+}
+
+// copyInner copies children of the inner node before the node itself, so that the node
+// can be written with new positions of the children. Position of the node is updated in place.
+func (c *Compaction) copyInner(in *inner) error {
+	if c.relocate(in) {
+		return nil
+	}
+	if err := in.sync(c.src); err != nil {
+		return err
+	}
+	for _, child := range []node{in.left, in.right} {
+		var err error
+		switch n := child.(type) {
+		case *inner:
+			err = c.copyInner(n)
+		case *leaf:
+			err = c.copyLeaf(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	idx, pos := in.Position()
+	buf := in.Marshal()
+	in.idx, in.pos = c.dst.TreeOffsetFor(len(buf))
+	if err := c.writeTree(buf); err != nil {
+		return err
+	}
+	c.moved[position(idx, pos)] = position(in.Position())
+	in.left, in.right = nil, nil
+	in.synced = false
+	return nil
+}
+
+func (c *Compaction) copyLeaf(l *leaf) error {
+	if c.relocate(l) {
+		return nil
+	}
+	if err := l.sync(c.src); err != nil {
+		return err
+	}
+	valueSize := len(l.value)
+	if l.written {
+		valueSize = int(l.valueSize)
+		if store.ValueChunkSize(c.dst) > 0 {
+			// chunks are copied one by one, value is not loaded
+			if err := l.copyChunks(c.src, c.dst); err != nil {
+				return err
+			}
+		} else {
+			if err := l.syncValue(c.src); err != nil {
+				return err
+			}
+			l.written = false
+		}
+	}
+	idx, pos := l.Position()
+	l.dirty = true
+	l.Allocate(c.dst)
+	if err := l.Commit(c.dst); err != nil {
+		return err
+	}
+	c.moved[position(idx, pos)] = position(l.Position())
+	c.throttle(l.Size() + len(l.preimage) + valueSize + 4)
+	return nil
+}
+
+// relocate updates position of the node if it was already copied.
+func (c *Compaction) relocate(n node) bool {
+	moved, exist := c.moved[position(n.Position())]
+	if !exist {
+		return false
+	}
+	idx, pos := uint32(moved>>32), uint32(moved)
+	switch n := n.(type) {
+	case *inner:
+		n.idx, n.pos = idx, pos
+	case *leaf:
+		n.idx, n.pos = idx, pos
+	}
+	return true
+}
+
+func (c *Compaction) writeTree(buf []byte) error {
+	n, err := c.dst.WriteTree(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("partial tree write")
+	}
+	c.throttle(n)
+	return nil
+}
+
+// throttle sleeps if compaction writes faster than allowed by options.
+func (c *Compaction) throttle(n int) {
+	if c.opts.BytesPerSecond == 0 {
+		return
+	}
+	c.written += n
+	expected := time.Duration(float64(c.written) / float64(c.opts.BytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(c.started); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+func position(idx, pos uint32) uint64 {
+	return uint64(idx)<<32 | uint64(pos)
+}
@@ -0,0 +1,262 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func dirSize(tb testing.TB, path string) int64 {
+	var size int64
+	require.NoError(tb, filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	}))
+	return size
+}
+
+func commitOverwrites(tb testing.TB, tree *Tree, keys [][]byte, versions int) [][][]byte {
+	values := make([][][]byte, versions)
+	for i := 0; i < versions; i++ {
+		for _, key := range keys {
+			value := make([]byte, 100)
+			rand.Read(value)
+			require.NoError(tb, tree.Put(key, value))
+			values[i] = append(values[i], value)
+		}
+		require.NoError(tb, tree.Commit())
+	}
+	return values
+}
+
+func TestCompact(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-compact-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 4096
+	conf.TreeWriteBuffer = 4096
+	conf.ValueWriteBuffer = 4096
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 10)
+	require.NoError(t, tree.PruneVersions(8))
+
+	before := dirSize(t, tmp)
+	require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+	require.Less(t, dirSize(t, tmp), before/3)
+	require.Equal(t, uint64(1), st.Generation())
+	// files of the first generation are removed from the root directory
+	entries, err := ioutil.ReadDir(tmp)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		for _, prefix := range []string{"tree-", "value-", "version-", "commit-", "meta-", "roots-"} {
+			require.False(t, strings.HasPrefix(entry.Name(), prefix), "file %s is left", entry.Name())
+		}
+	}
+
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[9][i], val)
+	}
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(10), tree.Version())
+	for version := 9; version <= 10; version++ {
+		snap, err := tree.VersionSnapshot(uint64(version))
+		require.NoError(t, err)
+		for i, key := range keys {
+			val, err := snap.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, values[version-1][i], val)
+		}
+	}
+	_, err = tree.VersionSnapshot(8)
+	require.Error(t, err)
+
+	values = append(values, commitOverwrites(t, tree, keys, 1)...)
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[10][i], val)
+	}
+}
+
+func TestCompactConcurrentCommits(t *testing.T) {
+	tree, closer := setupFullTreeP(t, 0)
+	defer closer()
+
+	keys := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 5)
+
+	c, err := tree.StartCompaction(CompactionOptions{BytesPerSecond: 1 << 20})
+	require.NoError(t, err)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Run(context.Background())
+	}()
+	values = append(values, commitOverwrites(t, tree, keys, 5)...)
+	require.NoError(t, <-errc)
+	require.NoError(t, tree.FinishCompaction(context.Background(), c))
+
+	for version := range values {
+		snap, err := tree.VersionSnapshot(uint64(version + 1))
+		require.NoError(t, err)
+		for i, key := range keys {
+			val, err := snap.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, values[version][i], val)
+		}
+	}
+}
+
+func TestSafeCompactConcurrentPuts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-safe-compact-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	st, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	defer st.Close()
+	tree := &SafeTree{tree: NewTree(st)}
+	keys := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	commitOverwrites(t, tree.tree, keys, 5)
+
+	// tree almost always has uncommitted changes
+	var (
+		wg     sync.WaitGroup
+		stop   = make(chan struct{})
+		values = map[string][]byte{}
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key, value := keys[rand.Intn(len(keys))], make([]byte, 10)
+			rand.Read(value)
+			require.NoError(t, tree.Put(key, value))
+			values[string(key)] = value
+			time.Sleep(time.Millisecond)
+			if i%5 == 0 {
+				require.NoError(t, tree.Commit())
+			}
+		}
+	}()
+	require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+	close(stop)
+	wg.Wait()
+	require.NoError(t, tree.Commit())
+	_, err = os.Stat(filepath.Join(tmp, "gen-1"))
+	require.NoError(t, err)
+
+	for key, value := range values {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+	require.NoError(t, tree.LoadLatest())
+	for key, value := range values {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+}
+
+func TestCompactEncrypted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-compact-encrypted-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.EncryptionKey = make([]byte, 32)
+	rand.Read(conf.EncryptionKey)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = make([]byte, 16)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 3)
+	meta := make([]byte, 32)
+	rand.Read(meta)
+	require.NoError(t, tree.Put(keys[0], values[2][0]))
+	require.NoError(t, tree.CommitWithMeta(meta))
+	require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+	require.Equal(t, uint64(1), st.Generation())
+	require.NoError(t, st.Close())
+
+	require.NoError(t, filepath.Walk(tmp, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			require.False(t, bytes.Contains(data, key), "key in %s", path)
+			require.False(t, bytes.Contains(data, values[2][i]), "value in %s", path)
+		}
+		require.False(t, bytes.Contains(data, meta), "meta in %s", path)
+		return nil
+	}))
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[2][i], val)
+	}
+	rst, err := tree.VersionMeta(tree.Version())
+	require.NoError(t, err)
+	require.Equal(t, meta, rst)
+}
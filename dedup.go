@@ -0,0 +1,176 @@
+package urkeltrie
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// Shared leaf is written if deduplication is enabled in the store. Record stores the preimage
+// and the hash of the value, the body of the value is shared by all leaves with the same value:
+//
+//	key | value hash | value idx | value pos | body size (uint32) | flags | preimage size (uint16) | preimage | crc
+//
+// Body is encoded as described in body.go but without preimage, hash of the value is used as additional data
+// for encryption. Preimage is encoded in the same way, with key as additional data.
+const (
+	sharedHeaderSize = size + size + 4 + 4 + 4 + 1 + 2
+
+	sharedBodyEncoded     = 1
+	sharedPreimageEncoded = 2
+
+	// leaves space for the header and encryption overhead
+	maxSharedPreimage = 1<<16 - 1 - 64
+)
+
+// encodeShared prepares preimage for the shared record. Body is encoded on commit if value is not found
+// in the index.
+func (l *leaf) encodeShared(aead cipher.AEAD) {
+	l.ntype = sharedLeafNode
+	l.deduped = false
+	l.valueHash = sum(l.value)
+	l.preimageBody, l.preimageEncoded = encodeBody(nil, aead != nil, l.preimage, nil)
+	l.preimageSize = sealedSize(aead, l.preimageBody, l.preimageEncoded)
+	l.body = nil
+}
+
+// sealShared encodes and seals body of the value unless it is already in the index, and seals the preimage.
+func (l *leaf) sealShared(s store.Backend) error {
+	var (
+		aead  = store.ValueCipher(s)
+		index = store.DedupIndex(s)
+		err   error
+	)
+	l.body = nil
+	if index != nil {
+		if ref, exist := index.Lookup(l.valueHash); exist {
+			l.setValueRef(ref)
+		}
+	}
+	if !l.deduped {
+		l.body, l.encoded = encodeBody(store.ValueCodec(s), aead != nil, nil, l.value)
+		l.bodySize = sealedSize(aead, l.body, l.encoded)
+		l.body, err = sealBody(aead, l.body, l.encoded, l.valueHash[:])
+		if err != nil {
+			return err
+		}
+		l.body = appendCrc(l.body, l.bodySize)
+	}
+	l.preimageBody, err = sealBody(aead, l.preimageBody, l.preimageEncoded, l.key[:])
+	return err
+}
+
+// placeShared allocates offset for the body, unless identical body was added to the index after
+// the leaf was sealed, e.g. by another leaf in the same commit.
+func (l *leaf) placeShared(s store.Backend) [][]byte {
+	if l.deduped {
+		return nil
+	}
+	index := store.DedupIndex(s)
+	if index != nil {
+		if ref, exist := index.Lookup(l.valueHash); exist {
+			l.setValueRef(ref)
+			l.body = nil
+			return nil
+		}
+	}
+	l.valueIdx, l.valuePos = s.ValueOffsetFor(len(l.body))
+	if index != nil {
+		index.Add(l.valueHash, l.valueRef())
+	}
+	return [][]byte{l.body}
+}
+
+func (l *leaf) setValueRef(ref store.ValueRef) {
+	l.valueIdx, l.valuePos = ref.Index, ref.Offset
+	l.bodySize, l.encoded = int(ref.Size), ref.Encoded
+	l.deduped = true
+}
+
+func (l *leaf) valueRef() store.ValueRef {
+	return store.ValueRef{
+		Index:   l.valueIdx,
+		Offset:  l.valuePos,
+		Size:    uint32(l.bodySize),
+		Encoded: l.encoded,
+	}
+}
+
+func (l *leaf) marshalShared(preimage []byte) []byte {
+	buf := make([]byte, l.Size())
+	copy(buf, l.key[:])
+	copy(buf[32:], l.valueHash[:])
+	order.PutUint32(buf[64:], l.valueIdx)
+	order.PutUint32(buf[68:], l.valuePos)
+	order.PutUint32(buf[72:], uint32(l.bodySize))
+	if l.encoded {
+		buf[76] |= sharedBodyEncoded
+	}
+	if l.preimageEncoded {
+		buf[76] |= sharedPreimageEncoded
+	}
+	order.PutUint16(buf[77:], uint16(len(preimage)))
+	copy(buf[sharedHeaderSize:], preimage)
+	putCrcSum32(buf[len(buf)-4:], buf[:len(buf)-4])
+	return buf
+}
+
+func (l *leaf) unmarshalShared(buf []byte) error {
+	_ = buf[l.Size()-1]
+	if crcSum32(buf[:len(buf)-4]) != order.Uint32(buf[len(buf)-4:]) {
+		return ErrCRC
+	}
+	copy(l.key[:], buf)
+	copy(l.valueHash[:], buf[32:])
+	l.valueIdx = order.Uint32(buf[64:])
+	l.valuePos = order.Uint32(buf[68:])
+	l.bodySize = int(order.Uint32(buf[72:]))
+	l.encoded = buf[76]&sharedBodyEncoded > 0
+	l.preimageEncoded = buf[76]&sharedPreimageEncoded > 0
+	l.preimageSize = int(order.Uint16(buf[77:]))
+	return nil
+}
+
+// syncShared reads the record from the tree group and the body from the value group.
+// Body is added to the index, so that new leaves with the same value can reuse it.
+func (l *leaf) syncShared(s store.Backend) error {
+	err := store.ViewTree(s, l.idx, l.pos, sharedHeaderSize, func(header []byte) error {
+		l.preimageSize = int(order.Uint16(header[sharedHeaderSize-2:]))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	var section []byte
+	err = store.ViewTree(s, l.idx, l.pos, l.Size(), func(buf []byte) error {
+		if err := l.unmarshalShared(buf); err != nil {
+			return err
+		}
+		// preimage is retained by the leaf and can't point to the mapped memory
+		section = append([]byte{}, buf[sharedHeaderSize:sharedHeaderSize+l.preimageSize]...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	aead := store.ValueCipher(s)
+	_, preimage, err := decodeBody(aead, section, l.preimageEncoded, l.key[:], 0)
+	if err != nil {
+		return fmt.Errorf("failed to decode preimage of the leaf at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	body, err := l.readValueBody(s)
+	if err != nil {
+		return err
+	}
+	_, value, err := decodeBody(aead, body, l.encoded, l.valueHash[:], 0)
+	if err != nil {
+		return fmt.Errorf("failed to decode value at %d:%d. error %w", l.valueIdx, l.valuePos, err)
+	}
+	if index := store.DedupIndex(s); index != nil {
+		index.Add(l.valueHash, l.valueRef())
+	}
+	l.preimage, l.value = preimage, value
+	l.keyLength, l.valueLength = len(preimage), len(value)
+	return nil
+}
@@ -0,0 +1,119 @@
+package urkeltrie
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func fileSize(tb testing.TB, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(tb, err)
+	return info.Size()
+}
+
+func TestDedupValues(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		conf func(*store.Config)
+	}{
+		{desc: "plain"},
+		{desc: "encrypted", conf: func(conf *store.Config) {
+			conf.EncryptionKey = make([]byte, 32)
+			conf.ValueCodec = store.Flate
+		}},
+		{desc: "inline", conf: func(conf *store.Config) {
+			conf.InlineValueSize = 64
+		}},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-dedup-values-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			conf.DedupIndexSize = 100
+			if tc.conf != nil {
+				tc.conf(&conf)
+			}
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			plain := setupFullTree(t, 0)
+			tree := NewTree(st)
+
+			value := make([]byte, 1000)
+			rand.Read(value)
+			keys := [][]byte{}
+			for i := 0; i < 100; i++ {
+				key := make([]byte, 10)
+				rand.Read(key)
+				keys = append(keys, key)
+				require.NoError(t, tree.Put(key, value))
+				require.NoError(t, plain.Put(key, value))
+			}
+			require.NoError(t, tree.Commit())
+			require.NoError(t, plain.Commit())
+			require.Equal(t, plain.Hash(), tree.Hash())
+
+			valueFile := filepath.Join(tmp, "value-0.udb")
+			size := fileSize(t, valueFile)
+			require.Less(t, size, int64(2*len(value)))
+
+			// put that doesn't change the value doesn't write the leaf
+			treeFile := filepath.Join(tmp, "tree-0.udb")
+			treeSize := fileSize(t, treeFile)
+			require.NoError(t, tree.Put(keys[0], value))
+			require.NoError(t, plain.Put(keys[0], value))
+			require.NoError(t, tree.Commit())
+			require.NoError(t, plain.Commit())
+			require.Equal(t, size, fileSize(t, valueFile))
+			require.LessOrEqual(t, fileSize(t, treeFile)-treeSize, int64((lastBit+1)*innerSize))
+			require.NoError(t, st.Close())
+
+			// values that are read from disk are reused
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			val, err := tree.Get(keys[0])
+			require.NoError(t, err)
+			require.Equal(t, value, val)
+			key := []byte("new key")
+			require.NoError(t, tree.Put(key, value))
+			require.NoError(t, plain.Put(key, value))
+			keys = append(keys, key)
+			require.NoError(t, tree.Commit())
+			require.NoError(t, plain.Commit())
+			require.Equal(t, size, fileSize(t, valueFile))
+			require.NoError(t, st.Close())
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			defer st.Close()
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+			for _, key := range keys {
+				val, err := tree.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, value, val)
+			}
+			require.Less(t, dirSize(t, tmp), int64(len(keys)*len(value)))
+
+			// index of the new generation is filled by compaction
+			valueFile = filepath.Join(tmp, "gen-1", "value-0.udb")
+			size = fileSize(t, valueFile)
+			require.NoError(t, tree.Put([]byte("compacted key"), value))
+			require.NoError(t, tree.Commit())
+			require.Equal(t, size, fileSize(t, valueFile))
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package urkeltrie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// Export stream contains all nodes of the version in pre-order, so that import reproduces
+// exactly the same tree and root hash regardless of the on-disk format:
+//
+//	stream  = header node trailer
+//	header  = magic "URKT" | format version (uint16) | tree version (uint64) | root hash (32 bytes)
+//	node    = 0x00 (empty) | 0x02 node node (inner) |
+//	          0x01 key (32 bytes) | preimage length (uvarint) | preimage | value length (uvarint) | value (leaf)
+//	trailer = number of leaves (uint64) | crc32 castagnoli of all previous bytes (uint32)
+//
+// Integers are big endian.
+const (
+	exportMagic   = "URKT"
+	exportFormat  = 1
+	exportHeader  = len(exportMagic) + 2 + 8 + size
+	exportTrailer = 8 + 4
+
+	// preimage length is read before crc is checked, longer preimages are not exported
+	maxExportPreimage = 16 << 20
+	// initial buffer for the imported bytes, it grows as bytes are read
+	exportReadBuffer = 64 << 10
+)
+
+// ErrInvalidExport returned if import stream is malformed or doesn't match the root hash.
+var ErrInvalidExport = errors.New("invalid export stream")
+
+// Export writes all nodes of the committed version to the writer.
+func (t *Tree) Export(version uint64, w io.Writer) error {
+	if version == 0 {
+		return errors.New("version 0 is empty")
+	}
+	if err := t.waitCommits(); err != nil {
+		return err
+	}
+	tree := &Tree{store: t.store, metrics: t.metrics}
+	if err := tree.LoadVersion(version); err != nil {
+		return err
+	}
+	ew := &exportWriter{w: bufio.NewWriter(w), crc: crc32.New(crcTable)}
+	header := make([]byte, exportHeader)
+	copy(header, exportMagic)
+	order.PutUint16(header[4:], exportFormat)
+	order.PutUint64(header[6:], version)
+	copy(header[14:], tree.root.Hash())
+	ew.Write(header)
+	if err := ew.node(t.store, tree.root); err != nil {
+		return err
+	}
+	trailer := make([]byte, exportTrailer)
+	order.PutUint64(trailer, ew.leaves)
+	ew.Write(trailer[:8])
+	order.PutUint32(trailer[8:], ew.crc.Sum32())
+	ew.Write(trailer[8:])
+	if ew.err != nil {
+		return ew.err
+	}
+	return ew.w.Flush()
+}
+
+type exportWriter struct {
+	w      *bufio.Writer
+	crc    hash.Hash32
+	leaves uint64
+	err    error
+	varint [binary.MaxVarintLen64]byte
+}
+
+func (ew *exportWriter) Write(buf []byte) {
+	if ew.err != nil {
+		return
+	}
+	ew.crc.Write(buf)
+	_, ew.err = ew.w.Write(buf)
+}
+
+func (ew *exportWriter) bytes(buf []byte) {
+	ew.length(uint64(len(buf)))
+	ew.Write(buf)
+}
+
+func (ew *exportWriter) length(lth uint64) {
+	n := binary.PutUvarint(ew.varint[:], lth)
+	ew.Write(ew.varint[:n])
+}
+
+func (ew *exportWriter) node(s store.Backend, n node) error {
+	switch n := n.(type) {
+	case nil:
+		ew.Write([]byte{nullNode})
+	case *inner:
+		if err := n.sync(s); err != nil {
+			return err
+		}
+		defer n.reset()
+		ew.Write([]byte{innerNode})
+		if err := ew.node(s, n.left); err != nil {
+			return err
+		}
+		if err := ew.node(s, n.right); err != nil {
+			return err
+		}
+	case *leaf:
+		if err := n.sync(s); err != nil {
+			return err
+		}
+		if len(n.preimage) > maxExportPreimage {
+			return fmt.Errorf("preimage of the key %x is too large for export, %d > %d",
+				n.key, len(n.preimage), maxExportPreimage)
+		}
+		ew.Write([]byte{leafNode})
+		ew.Write(n.key[:])
+		ew.bytes(n.preimage)
+		if n.written && n.value == nil {
+			// chunks are written as they are read, value is not loaded
+			ew.length(n.valueSize)
+			if err := n.eachChunk(s, func(_ int, chunk []byte) error {
+				ew.Write(chunk)
+				return ew.err
+			}); err != nil {
+				return err
+			}
+		} else {
+			ew.bytes(n.value)
+		}
+		ew.leaves++
+	}
+	return ew.err
+}
+
+// Import writes all nodes from the stream created by Export and commits them as the next version.
+// Nodes are written as soon as they are read, so that the tree is never fully loaded in memory.
+// If the root hash of the imported nodes doesn't match the root hash in the stream nothing is committed.
+func (t *Tree) Import(r io.Reader) error {
+	if t.root != nil && t.root.isDirty() {
+		return ErrDirtyTree
+	}
+	if err := t.waitCommits(); err != nil {
+		return err
+	}
+	ir := &importReader{r: bufio.NewReader(r), crc: crc32.New(crcTable)}
+	header := make([]byte, exportHeader)
+	if err := ir.read(header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte(exportMagic)) {
+		return fmt.Errorf("%w: unknown magic %x", ErrInvalidExport, header[:4])
+	}
+	if format := order.Uint16(header[4:]); format != exportFormat {
+		return fmt.Errorf("%w: unsupported format %d", ErrInvalidExport, format)
+	}
+	ntype, err := ir.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ntype != innerNode {
+		return fmt.Errorf("%w: root must be an inner node", ErrInvalidExport)
+	}
+	root := newInner(0)
+	if err := ir.inner(t.store, root); err != nil {
+		return err
+	}
+	trailer := make([]byte, exportTrailer)
+	if err := ir.read(trailer[:8]); err != nil {
+		return err
+	}
+	crc := ir.crc.Sum32()
+	if _, err := io.ReadFull(ir.r, trailer[8:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	if crc != order.Uint32(trailer[8:]) {
+		return fmt.Errorf("%w: crc mismatch", ErrInvalidExport)
+	}
+	if leaves := order.Uint64(trailer); leaves != ir.leaves {
+		return fmt.Errorf("%w: expected %d leaves, imported %d", ErrInvalidExport, leaves, ir.leaves)
+	}
+	if !bytes.Equal(root.Hash(), header[14:]) {
+		return fmt.Errorf("%w: root hash %x doesn't match exported root %x", ErrInvalidExport, root.Hash(), header[14:])
+	}
+	t.root = root
+	return t.commitVersion(nil)
+}
+
+type importReader struct {
+	r      *bufio.Reader
+	crc    hash.Hash32
+	leaves uint64
+}
+
+func (ir *importReader) ReadByte() (byte, error) {
+	b, err := ir.r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	ir.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (ir *importReader) read(buf []byte) error {
+	if _, err := io.ReadFull(ir.r, buf); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	ir.crc.Write(buf)
+	return nil
+}
+
+// Read reads from the stream and updates crc, it is used to write chunks of the value directly from the stream.
+func (ir *importReader) Read(buf []byte) (int, error) {
+	n, err := ir.r.Read(buf)
+	ir.crc.Write(buf[:n])
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	return n, nil
+}
+
+// length reads the length prefix, length must not exceed the limit.
+func (ir *importReader) length(limit uint64) (uint64, error) {
+	lth, err := binary.ReadUvarint(ir)
+	if err != nil {
+		return 0, err
+	}
+	if lth > limit {
+		return 0, fmt.Errorf("%w: length %d is too large", ErrInvalidExport, lth)
+	}
+	return lth, nil
+}
+
+// bytes reads lth bytes. Buffer grows as bytes are read, so that a corrupted length fails at the end
+// of the stream instead of allocating memory up front.
+func (ir *importReader) bytes(lth uint64) ([]byte, error) {
+	capacity := lth
+	if capacity > exportReadBuffer {
+		capacity = exportReadBuffer
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, capacity))
+	if _, err := io.CopyN(buf, ir.r, int64(lth)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	ir.crc.Write(buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// inner reads children of the inner node and writes them before the node itself.
+// Position and hash of the node are set and children are released.
+func (ir *importReader) inner(s store.Backend, in *inner) error {
+	for _, right := range []bool{false, true} {
+		ntype, err := ir.ReadByte()
+		if err != nil {
+			return err
+		}
+		var child node
+		switch ntype {
+		case nullNode:
+		case innerNode:
+			if in.bit == lastBit {
+				return fmt.Errorf("%w: inner node below the last bit", ErrInvalidExport)
+			}
+			child = newInner(in.bit + 1)
+			if err := ir.inner(s, child.(*inner)); err != nil {
+				return err
+			}
+		case leafNode:
+			l, err := ir.leaf(s)
+			if err != nil {
+				return err
+			}
+			child = l
+		default:
+			return fmt.Errorf("%w: unknown node type %d", ErrInvalidExport, ntype)
+		}
+		if right {
+			in.right = child
+		} else {
+			in.left = child
+		}
+	}
+	_ = in.Hash()
+	buf := in.Marshal()
+	in.idx, in.pos = s.TreeOffsetFor(len(buf))
+	n, err := s.WriteTree(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("partial tree write")
+	}
+	in.dirty = false
+	in.left, in.right = nil, nil
+	return nil
+}
+
+func (ir *importReader) leaf(s store.Backend) (*leaf, error) {
+	var key [size]byte
+	if err := ir.read(key[:]); err != nil {
+		return nil, err
+	}
+	lth, err := ir.length(maxExportPreimage)
+	if err != nil {
+		return nil, err
+	}
+	preimage, err := ir.bytes(lth)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := store.ValueChunkSize(s)
+	limit := uint64(maxValueSize)
+	if chunkSize > 0 {
+		limit = maxChunkedValueSize(len(preimage), chunkSize)
+	}
+	lth, err = ir.length(limit)
+	if err != nil {
+		return nil, err
+	}
+	var l *leaf
+	if chunkSize > 0 && lth > uint64(chunkSize) {
+		// large value is written chunk by chunk as it is read from the stream
+		l = newLeaf(key, preimage, nil)
+		if err := l.writeChunks(s, ir, int64(lth), chunkSize); err != nil {
+			return nil, err
+		}
+	} else {
+		value, err := ir.bytes(lth)
+		if err != nil {
+			return nil, err
+		}
+		l = newLeaf(key, preimage, value)
+	}
+	l.Allocate(s)
+	if err := l.Commit(s); err != nil {
+		return nil, err
+	}
+	_ = l.Hash()
+	l.preimage, l.value = nil, nil
+	ir.leaves++
+	return l, nil
+}
@@ -0,0 +1,155 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	tree := setupFullTree(t, 0)
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 3)
+	for _, key := range keys[:10] {
+		require.NoError(t, tree.Delete(key))
+	}
+	require.NoError(t, tree.Commit())
+
+	// values of the version 4 are from the version 3 without deleted keys
+	for _, tc := range []struct {
+		version uint64
+		values  [][]byte
+	}{{2, values[1]}, {4, values[2]}} {
+		version := tc.version
+		var buf bytes.Buffer
+		require.NoError(t, tree.Export(version, &buf))
+		expected, err := tree.VersionSnapshot(version)
+		require.NoError(t, err)
+
+		conf := store.DefaultConfig("")
+		conf.InlineValueSize = 32
+		conf.ValueCodec = store.Flate
+		st, err := store.Open(conf)
+		require.NoError(t, err)
+		imported := NewTree(st)
+		require.NoError(t, imported.Import(&buf))
+		require.Equal(t, uint64(1), imported.Version())
+		require.Equal(t, expected.Hash(), imported.Hash())
+
+		require.NoError(t, imported.LoadLatest())
+		require.Equal(t, expected.Hash(), imported.Hash())
+		for i, key := range keys {
+			val, err := imported.Get(key)
+			if version == 4 && i < 10 {
+				require.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.values[i], val)
+		}
+		require.NoError(t, st.Close())
+	}
+}
+
+func TestImportCorrupted(t *testing.T) {
+	tree := setupFullTree(t, 0)
+	commitRandomVersions(t, tree, 10)
+	var buf bytes.Buffer
+	require.NoError(t, tree.Export(tree.Version(), &buf))
+	data := buf.Bytes()
+
+	// value changed
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-exportTrailer-1] ^= 0xff
+	require.True(t, errors.Is(NewTree(tree.store).Import(bytes.NewReader(corrupted)), ErrInvalidExport))
+
+	// value changed and crc adjusted
+	putCrcSum32(corrupted[len(corrupted)-4:], corrupted[:len(corrupted)-4])
+	imported := setupFullTree(t, 0)
+	version := imported.Version()
+	err := imported.Import(bytes.NewReader(corrupted))
+	require.True(t, errors.Is(err, ErrInvalidExport), "error: %v", err)
+	require.Equal(t, version, imported.Version())
+
+	// truncated
+	require.True(t, errors.Is(setupFullTree(t, 0).Import(bytes.NewReader(data[:len(data)/2])), ErrInvalidExport))
+
+	require.NoError(t, setupFullTree(t, 0).Import(bytes.NewReader(data)))
+}
+
+func TestImportLengthLimits(t *testing.T) {
+	stream := func(preimage, value uint64) []byte {
+		buf := make([]byte, exportHeader)
+		copy(buf, exportMagic)
+		order.PutUint16(buf[4:], exportFormat)
+		buf = append(buf, innerNode, leafNode)
+		buf = append(buf, make([]byte, size)...)
+		buf = appendUvarint(buf, preimage)
+		if preimage == 0 {
+			buf = appendUvarint(buf, value)
+		}
+		return append(buf, make([]byte, 100)...)
+	}
+	conf := store.DefaultConfig("")
+	conf.ValueChunkSize = 1 << 10
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	for _, tc := range []struct {
+		desc            string
+		preimage, value uint64
+	}{
+		{"preimage over limit", maxExportPreimage + 1, 0},
+		{"preimage longer than stream", maxExportPreimage, 0},
+		{"value overflows", 0, 1 << 63},
+		{"chunked value over limit", 0, maxChunkedValueSize(0, 1<<10) + 1},
+		{"chunked value longer than stream", 0, maxChunkedValueSize(0, 1<<10)},
+		{"value longer than stream", 0, 1 << 10},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := NewTree(st).Import(bytes.NewReader(stream(tc.preimage, tc.value)))
+			require.True(t, errors.Is(err, ErrInvalidExport), "error: %v", err)
+		})
+	}
+}
+
+func TestExportImportChunked(t *testing.T) {
+	tree := setupFullTree(t, 0)
+	keys := [][]byte{}
+	values := [][]byte{}
+	for i := 0; i < 10; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		value := make([]byte, 100+i*1000)
+		rand.Read(value)
+		require.NoError(t, tree.Put(key, value))
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	require.NoError(t, tree.Commit())
+	var buf bytes.Buffer
+	require.NoError(t, tree.Export(tree.Version(), &buf))
+
+	conf := store.DefaultConfig("")
+	conf.ValueChunkSize = 1 << 10
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	imported := NewTree(st)
+	require.NoError(t, imported.Import(&buf))
+	require.Equal(t, tree.Hash(), imported.Hash())
+	require.NoError(t, imported.LoadLatest())
+	for i, key := range keys {
+		val, err := imported.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[i], val)
+	}
+}
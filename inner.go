@@ -17,15 +17,23 @@ const (
 	nullNode byte = iota
 	leafNode
 	innerNode
+	// encodedLeafNode is a leaf with a value encoded by a codec from the store.
+	encodedLeafNode
+	// inlineLeafNode is a leaf with a body stored in the tree group.
+	inlineLeafNode
+	// sharedLeafNode is a leaf with a body that may be shared with other leaves.
+	sharedLeafNode
+	// chunkedLeafNode is a leaf with a value that is split into chunks.
+	chunkedLeafNode
 )
 
 func nodeType(n node) byte {
 	if n != nil {
-		switch n.(type) {
+		switch n := n.(type) {
 		case *inner:
 			return innerNode
 		case *leaf:
-			return leafNode
+			return n.ntype
 		default:
 			panic("unknown type")
 		}
@@ -65,19 +73,15 @@ func (in *inner) String() string {
 	return fmt.Sprintf("Inner<%d,%d:%d>", in.bit, in.idx, in.pos)
 }
 
+// copy returns a clean node at the same position. Hash is copied, as it is reused when the node is changed.
 func (in *inner) copy() *inner {
-	return createInner(in.bit, in.idx, in.pos, in.Hash())
+	return createInner(in.bit, in.idx, in.pos, append(make([]byte, 0, size), in.Hash()...))
 }
 
-func (in *inner) Allocate(store *store.FileStore) {
+// Allocate encodes bodies of the dirty leaves and reserves offsets for the dirty nodes, see commit.go.
+func (in *inner) Allocate(store store.Backend) {
 	if in.dirty {
-		in.idx, in.pos = store.TreeOffsetFor(in.Size())
-		if in.left != nil {
-			in.left.Allocate(store)
-		}
-		if in.right != nil {
-			in.right.Allocate(store)
-		}
+		allocateNodes(store, in)
 	}
 }
 
@@ -85,7 +89,7 @@ func (in *inner) Position() (uint32, uint32) {
 	return in.idx, in.pos
 }
 
-func (in *inner) iterateChild(store *store.FileStore, child node, reverse bool, iterf IterateFunc) (bool, error) {
+func (in *inner) iterateChild(store store.Backend, child node, reverse bool, iterf IterateFunc) (bool, error) {
 	if child == nil {
 		return false, nil
 	}
@@ -102,7 +106,7 @@ func (in *inner) iterateChild(store *store.FileStore, child node, reverse bool,
 	return false, nil
 }
 
-func (in *inner) iterate(store *store.FileStore, reverse bool, iterf IterateFunc) (bool, error) {
+func (in *inner) iterate(store store.Backend, reverse bool, iterf IterateFunc) (bool, error) {
 	if err := in.sync(store); err != nil {
 		return false, err
 	}
@@ -123,7 +127,7 @@ func (in *inner) iterate(store *store.FileStore, reverse bool, iterf IterateFunc
 	return false, nil
 }
 
-func (in *inner) Get(store *store.FileStore, key [size]byte) ([]byte, error) {
+func (in *inner) Get(store store.Backend, key [size]byte) ([]byte, error) {
 	if err := in.sync(store); err != nil {
 		return nil, err
 	}
@@ -140,24 +144,28 @@ func (in *inner) Get(store *store.FileStore, key [size]byte) ([]byte, error) {
 	return in.left.Get(store, key)
 }
 
-func (in *inner) Sync(store *store.FileStore) error {
+func (in *inner) Sync(store store.Backend) error {
 	return in.sync(store)
 }
 
-func (in *inner) sync(store *store.FileStore) error {
+func (in *inner) sync(s store.Backend) error {
 	if !in.synced && !in.dirty {
+		if cached, exist := store.CachedNode(s, in.idx, in.pos); exist {
+			in.load(cached.(*innerRecord))
+			in.synced = true
+			return nil
+		}
 		// sync the state from disk
-		buf := make([]byte, in.Size())
-		n, err := store.ReadTreeAt(in.idx, in.pos, buf)
+		var record *innerRecord
+		err := store.ViewTree(s, in.idx, in.pos, in.Size(), func(buf []byte) (err error) {
+			record, err = in.decode(buf)
+			return err
+		})
 		if err != nil {
 			return fmt.Errorf("failed inner tree read at %d:%d. error %w", in.idx, in.pos, err)
 		}
-		if n != in.Size() {
-			return fmt.Errorf("partial read for inner node: %d != %d", n, in.Size())
-		}
-		if err := in.Unmarshal(buf); err != nil {
-			return err
-		}
+		store.CacheNode(s, in.idx, in.pos, record, innerRecordSize)
+		in.load(record)
 		in.synced = true
 	}
 	return nil
@@ -200,7 +208,7 @@ func (in *inner) empty() bool {
 	return in.left == nil && in.right == nil
 }
 
-func (in *inner) Delete(store *store.FileStore, key [size]byte) (bool, bool, error) {
+func (in *inner) Delete(store store.Backend, key [size]byte) (bool, bool, error) {
 	if err := in.sync(store); err != nil {
 		return false, false, err
 	}
@@ -240,7 +248,7 @@ func (in *inner) Delete(store *store.FileStore, key [size]byte) (bool, bool, err
 	return false, changed, nil
 }
 
-func (in *inner) Insert(store *store.FileStore, nodes ...*leaf) error {
+func (in *inner) Insert(store store.Backend, nodes ...*leaf) error {
 	if err := in.sync(store); err != nil {
 		return err
 	}
@@ -255,7 +263,7 @@ func (in *inner) Insert(store *store.FileStore, nodes ...*leaf) error {
 	return nil
 }
 
-func (in *inner) insert(store *store.FileStore, n *leaf) error {
+func (in *inner) insert(store store.Backend, n *leaf) error {
 	if bitSet(n.key, in.bit) {
 		if in.right == nil {
 			in.right = n
@@ -265,6 +273,11 @@ func (in *inner) insert(store *store.FileStore, n *leaf) error {
 		case *inner:
 			return tmp.Insert(store, n)
 		case *leaf:
+			if in.bit == lastBit && n.written {
+				// value of the new leaf is already in the store
+				in.right = n
+				return nil
+			}
 			if in.bit == lastBit {
 				return tmp.Put(store, n.key, n.value)
 			}
@@ -285,6 +298,11 @@ func (in *inner) insert(store *store.FileStore, n *leaf) error {
 	case *inner:
 		return tmp.Insert(store, n)
 	case *leaf:
+		if in.bit == lastBit && n.written {
+			// value of the new leaf is already in the store
+			in.left = n
+			return nil
+		}
 		if in.bit == lastBit {
 			return tmp.Put(store, n.key, n.value)
 		}
@@ -311,7 +329,7 @@ func (in *inner) rhash() []byte {
 	return zerosHash[:]
 }
 
-func (in *inner) Prove(store *store.FileStore, key [32]byte, proof *Proof) error {
+func (in *inner) Prove(store store.Backend, key [32]byte, proof *Proof) error {
 	if err := in.sync(store); err != nil {
 		return err
 	}
@@ -332,39 +350,12 @@ func (in *inner) Prove(store *store.FileStore, key [32]byte, proof *Proof) error
 	return nil
 }
 
-func (in *inner) Commit(store *store.FileStore) error {
+// Commit writes dirty nodes of the allocated subtree, see commit.go.
+func (in *inner) Commit(store store.Backend) error {
 	if !in.dirty {
 		return nil
 	}
-	buf := innerPool.Get().([]byte)
-	in.MarshalTo(buf)
-	n, err := store.WriteTree(buf)
-	for i := range buf {
-		buf[i] = 0
-	}
-	if err != nil {
-		return err
-	}
-	innerPool.Put(buf)
-	if n != in.Size() {
-		return errors.New("partial tree write")
-	}
-	in.dirty = false
-	if in.left != nil {
-		err = in.left.Commit(store)
-		if err != nil {
-			return err
-		}
-	}
-	if in.right != nil {
-		err = in.right.Commit(store)
-		if err != nil {
-			return err
-		}
-	}
-	// eagerly prehash nodes starting from the leafs of the inserted branch
-	_ = in.Hash()
-	return nil
+	return commitNodes(store, in)
 }
 
 func (in *inner) Hash() []byte {
@@ -431,34 +422,74 @@ func (in *inner) MarshalTo(buf []byte) {
 }
 
 func (in *inner) Unmarshal(buf []byte) error {
+	record, err := in.decode(buf)
+	if err != nil {
+		return err
+	}
+	in.load(record)
+	return nil
+}
+
+// approximate memory used by innerRecord
+const innerRecordSize = 2 + 4*4 + 2*size
+
+// innerRecord is a decoded inner node. It is shared by trees through the node cache and must not be modified.
+type innerRecord struct {
+	ltype, rtype       byte
+	leftIdx, leftPos   uint32
+	rightIdx, rightPos uint32
+	leftHash           [size]byte
+	rightHash          [size]byte
+}
+
+// record returns the record of the node without marshaling it. Children must be allocated.
+func (in *inner) record() *innerRecord {
+	record := &innerRecord{
+		ltype: nodeType(in.left),
+		rtype: nodeType(in.right),
+	}
+	if in.left != nil {
+		record.leftIdx, record.leftPos = in.left.Position()
+		copy(record.leftHash[:], in.left.Hash())
+	}
+	if in.right != nil {
+		record.rightIdx, record.rightPos = in.right.Position()
+		copy(record.rightHash[:], in.right.Hash())
+	}
+	return record
+}
+
+func (in *inner) decode(buf []byte) (*innerRecord, error) {
 	_ = buf[in.Size()-1]
 	// crc unmarshals in big endian as well
 	if crcSum32(buf[:82]) != order.Uint32(buf[82:]) {
-		return fmt.Errorf("%w: inner node at height %d", ErrCRC, in.bit)
-	}
-	ltype := buf[0]
-	rtype := buf[1]
-	leftIdx := order.Uint32(buf[2:])
-	leftPos := order.Uint32(buf[6:])
-	rightIdx := order.Uint32(buf[10:])
-	rightPos := order.Uint32(buf[14:])
-	if ltype != nullNode {
-		leftHash := make([]byte, 32)
-		copy(leftHash, buf[18:])
-		if ltype == innerNode {
-			in.left = createInner(in.bit+1, leftIdx, leftPos, leftHash)
-		} else if ltype == leafNode {
-			in.left = createLeaf(leftIdx, leftPos, leftHash)
-		}
-	}
-	if rtype != nullNode {
-		rightHash := make([]byte, 32)
-		copy(rightHash, buf[50:])
-		if rtype == innerNode {
-			in.right = createInner(in.bit+1, rightIdx, rightPos, rightHash)
-		} else if rtype == leafNode {
-			in.right = createLeaf(rightIdx, rightPos, rightHash)
-		}
+		return nil, fmt.Errorf("%w: inner node at height %d", ErrCRC, in.bit)
+	}
+	record := &innerRecord{
+		ltype:    buf[0],
+		rtype:    buf[1],
+		leftIdx:  order.Uint32(buf[2:]),
+		leftPos:  order.Uint32(buf[6:]),
+		rightIdx: order.Uint32(buf[10:]),
+		rightPos: order.Uint32(buf[14:]),
+	}
+	copy(record.leftHash[:], buf[18:])
+	copy(record.rightHash[:], buf[50:])
+	return record, nil
+}
+
+// load creates children from the record. Hashes are copied as they are reused when node is changed.
+func (in *inner) load(record *innerRecord) {
+	in.left = in.createChild(record.ltype, record.leftIdx, record.leftPos, record.leftHash)
+	in.right = in.createChild(record.rtype, record.rightIdx, record.rightPos, record.rightHash)
+}
+
+func (in *inner) createChild(ntype byte, idx, pos uint32, hash [size]byte) node {
+	switch ntype {
+	case innerNode:
+		return createInner(in.bit+1, idx, pos, append(make([]byte, 0, size), hash[:]...))
+	case leafNode, encodedLeafNode, inlineLeafNode, sharedLeafNode, chunkedLeafNode:
+		return createLeaf(ntype, idx, pos, append(make([]byte, 0, size), hash[:]...))
 	}
 	return nil
 }
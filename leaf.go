@@ -1,6 +1,7 @@
 package urkeltrie
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
@@ -12,17 +13,19 @@ func bitSet(key [32]byte, index uint8) bool {
 	return (key[pos] & (1 << bit)) > 0
 }
 
-func createLeaf(idx, pos uint32, hash []byte) *leaf {
+func createLeaf(ntype byte, idx, pos uint32, hash []byte) *leaf {
 	return &leaf{
-		pos:  pos,
-		idx:  idx,
-		hash: hash,
+		ntype: ntype,
+		pos:   pos,
+		idx:   idx,
+		hash:  hash,
 	}
 }
 
 func newLeaf(key [size]byte, preimage, value []byte) *leaf {
 	return &leaf{
 		dirty:       true,
+		ntype:       leafNode,
 		key:         key,
 		preimage:    preimage,
 		value:       value,
@@ -43,9 +46,37 @@ type leaf struct {
 	valueLength int
 
 	valueIdx, valuePos uint32
+
+	// ntype is the type of the leaf record, it is stored in the parent record.
+	// One of leafNode, encodedLeafNode, inlineLeafNode, sharedLeafNode or chunkedLeafNode.
+	ntype byte
+	// encoded is true if the body starts with a header, see body.go
+	encoded bool
+	// body is the value body prepared in Allocate and written in Commit
+	body []byte
+	// bodySize is the size of the stored body without crc
+	bodySize int
+
+	// shared leaf stores the hash of the value and the preimage in the record, see dedup.go
+	valueHash       [size]byte
+	preimageBody    []byte
+	preimageEncoded bool
+	preimageSize    int
+	// deduped is true if the body of the shared leaf was found in the index and is not written
+	deduped bool
+
+	// chunked leaf stores references to the chunks of the value in the record, see chunk.go
+	chunks []chunkRef
+	// chunkBodies are sealed chunks prepared in Commit
+	chunkBodies [][]byte
+	chunkSize   int
+	valueSize   uint64
+	// written is true if chunks were written by PutReader or read from the record,
+	// value is not kept in memory until it is requested
+	written bool
 }
 
-func (l *leaf) Sync(store *store.FileStore) error {
+func (l *leaf) Sync(store store.Backend) error {
 	return l.sync(store)
 }
 
@@ -53,54 +84,214 @@ func (l *leaf) isDirty() bool {
 	return l.dirty
 }
 
-func (l *leaf) sync(store *store.FileStore) error {
+func (l *leaf) sync(s store.Backend) error {
 	if !l.synced && !l.dirty {
-		buf := make([]byte, l.Size())
-
-		n, err := store.ReadTreeAt(l.idx, l.pos, buf)
-		if err != nil {
-			return fmt.Errorf("failed to load leaf node at %d:%d. read %d bytes. error %w", l.idx, l.pos, n, err)
+		if cached, exist := store.CachedNode(s, l.idx, l.pos); exist {
+			l.load(cached.(*leafRecord))
+			l.synced = true
+			return nil
 		}
-		if err := l.Unmarshal(buf); err != nil {
+		if err := l.read(s); err != nil {
 			return err
 		}
-		body := make([]byte, l.keyLength+l.valueLength+4)
-		_, err = store.ReadValueAt(l.valueIdx, l.valuePos, body)
+		l.synced = true
+		store.CacheNode(s, l.idx, l.pos, l.record(),
+			leafRecordSize+len(l.preimage)+len(l.value)+len(l.chunks)*chunkRefSize)
+	}
+	return nil
+}
+
+// syncValue syncs the leaf and loads chunks of the value.
+// Chunks are loaded only if the value is requested, e.g. by Get.
+func (l *leaf) syncValue(s store.Backend) error {
+	if err := l.sync(s); err != nil {
+		return err
+	}
+	if l.written && l.value == nil {
+		value, err := l.readChunks(s)
 		if err != nil {
-			return fmt.Errorf("failed to load value at %d:%d. error %w", l.valueIdx, l.valuePos, err)
+			return err
 		}
+		l.value = value
+	}
+	return nil
+}
 
-		if crcSum32(body[:l.keyLength+l.valueLength]) != order.Uint32(body[l.keyLength+l.valueLength:]) {
-			return fmt.Errorf("%w: leaf value corrupted", ErrCRC)
+// read loads the record and the body of the leaf from the store, bypassing the cache.
+func (l *leaf) read(s store.Backend) error {
+	var (
+		body []byte
+		err  error
+	)
+	switch l.ntype {
+	case sharedLeafNode:
+		err = l.syncShared(s)
+	case chunkedLeafNode:
+		err = l.readChunked(s)
+	case inlineLeafNode:
+		body, err = l.readInline(s)
+	default:
+		body, err = l.readBody(s)
+	}
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		if err := l.decodeBody(s, body); err != nil {
+			return fmt.Errorf("failed to decode value at %d:%d. error %w", l.valueIdx, l.valuePos, err)
 		}
-		l.preimage = body[:l.keyLength]
-		l.value = body[l.keyLength : l.keyLength+l.valueLength]
-		l.synced = true
 	}
 	return nil
 }
 
+// readBody reads the record from the tree group and the body without crc from the value group.
+func (l *leaf) readBody(s store.Backend) ([]byte, error) {
+	if err := l.readRecord(s); err != nil {
+		return nil, err
+	}
+	return l.readValueBody(s)
+}
+
+// readRecord reads the record of leafNode or encodedLeafNode from the tree group.
+func (l *leaf) readRecord(s store.Backend) error {
+	err := store.ViewTree(s, l.idx, l.pos, l.Size(), l.Unmarshal)
+	if err != nil {
+		return fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	l.encoded = l.ntype == encodedLeafNode
+	l.bodySize = l.keyLength + l.valueLength
+	if l.encoded {
+		l.bodySize++
+	}
+	return nil
+}
+
+// readValueBody reads the body of bodySize from the value group and checks crc.
+func (l *leaf) readValueBody(s store.Backend) ([]byte, error) {
+	return readValue(s, l.valueIdx, l.valuePos, l.bodySize)
+}
+
+// readValue reads the body of the size from the value group and checks crc.
+func readValue(s store.Backend, idx, pos uint32, size int) ([]byte, error) {
+	// value is retained by the leaf and can't point to the mapped memory
+	body := make([]byte, size+4)
+	_, err := s.ReadValueAt(idx, pos, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load value at %d:%d. error %w", idx, pos, err)
+	}
+	if crcSum32(body[:size]) != order.Uint32(body[size:]) {
+		return nil, fmt.Errorf("%w: leaf value at %d:%d", ErrCRC, idx, pos)
+	}
+	return body[:size], nil
+}
+
+// appendCrc appends crc of the body of the size.
+func appendCrc(body []byte, size int) []byte {
+	body = append(body, 0, 0, 0, 0)
+	putCrcSum32(body[size:], body[:size])
+	return body
+}
+
+// readInline reads the record with the body from the tree group. Header is read first to find
+// the size of the record, the second read is usually served by the read buffer.
+func (l *leaf) readInline(s store.Backend) ([]byte, error) {
+	err := store.ViewTree(s, l.idx, l.pos, inlineHeaderSize, func(header []byte) error {
+		l.bodySize = int(order.Uint16(header[inlineHeaderSize-2:]))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	var body []byte
+	err = store.ViewTree(s, l.idx, l.pos, l.Size(), func(buf []byte) error {
+		if err := l.unmarshalInline(buf); err != nil {
+			return err
+		}
+		// value is retained by the leaf and can't point to the mapped memory
+		body = append([]byte{}, buf[inlineHeaderSize:inlineHeaderSize+l.bodySize]...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load leaf node at %d:%d. error %w", l.idx, l.pos, err)
+	}
+	return body, nil
+}
+
+// approximate memory used by leafRecord without preimage and value
+const leafRecordSize = size + 2*4 + 2*24
+
+// leafRecord is a decoded leaf with a body. It is shared by trees through the node cache and must not be modified.
+type leafRecord struct {
+	key                [size]byte
+	valueIdx, valuePos uint32
+	preimage, value    []byte
+
+	// chunks of the value that was written by writeChunks and is not loaded
+	written   bool
+	chunks    []chunkRef
+	chunkSize int
+	valueSize uint64
+}
+
+func (l *leaf) record() *leafRecord {
+	record := &leafRecord{
+		key:      l.key,
+		valueIdx: l.valueIdx,
+		valuePos: l.valuePos,
+		preimage: l.preimage,
+		value:    l.value,
+	}
+	if l.written {
+		record.written = true
+		record.chunks, record.chunkSize, record.valueSize = l.chunks, l.chunkSize, l.valueSize
+	}
+	return record
+}
+
+func (l *leaf) load(record *leafRecord) {
+	l.key = record.key
+	l.valueIdx, l.valuePos = record.valueIdx, record.valuePos
+	l.keyLength, l.valueLength = len(record.preimage), len(record.value)
+	l.preimage, l.value = record.preimage, record.value
+	l.written = record.written
+	l.chunks, l.chunkSize, l.valueSize = record.chunks, record.chunkSize, record.valueSize
+}
+
 func (l *leaf) Position() (uint32, uint32) {
 	return l.idx, l.pos
 }
 
-func (l *leaf) Put(store *store.FileStore, key [32]byte, value []byte) error {
+func (l *leaf) Put(store store.Backend, key [32]byte, value []byte) error {
 	if err := l.sync(store); err != nil {
 		return err
 	}
-	if lth := len(value); lth > maxValueSize {
-		return fmt.Errorf("value is longer then max allower, %d > %d", lth, maxValueSize)
+	if err := checkValueSize(store, value); err != nil {
+		return err
 	}
 	// overwrite will create new branch. old version will be still accessible using previous root
 	if l.key == key {
+		// value of the written leaf is not in memory and can't be compared
+		if !l.dirty && !l.written && bytes.Equal(l.value, value) {
+			// record and body remain valid
+			return nil
+		}
 		l.hash = nil
 		l.value = value
 		l.dirty = true
+		l.written = false
+	}
+	return nil
+}
+
+// checkValueSize returns error if value is too large for the backend.
+func checkValueSize(s store.Backend, value []byte) error {
+	if lth := len(value); lth > maxValueSize && store.ValueChunkSize(s) == 0 {
+		return fmt.Errorf("value is longer then max allowed, %d > %d", lth, maxValueSize)
 	}
 	return nil
 }
 
-func (l *leaf) Delete(store *store.FileStore, key [size]byte) (bool, bool, error) {
+func (l *leaf) Delete(store store.Backend, key [size]byte) (bool, bool, error) {
 	if err := l.sync(store); err != nil {
 		return false, false, err
 	}
@@ -108,12 +299,13 @@ func (l *leaf) Delete(store *store.FileStore, key [size]byte) (bool, bool, error
 	return match, match, nil
 }
 
-func (l *leaf) Get(store *store.FileStore, key [size]byte) ([]byte, error) {
-	if err := l.sync(store); err != nil {
+func (l *leaf) Get(store store.Backend, key [size]byte) ([]byte, error) {
+	if err := l.syncValue(store); err != nil {
 		return nil, err
 	}
 	if l.key == key {
-		return l.value, nil
+		// value may be shared with the node cache, caller is allowed to modify returned value
+		return copyBytes(l.value), nil
 	}
 	return nil, fmt.Errorf("%w: collision, key %x not found", ErrNotFound, key)
 }
@@ -128,6 +320,14 @@ func (l *leaf) Hash() []byte {
 }
 
 func (l *leaf) Size() int {
+	switch l.ntype {
+	case inlineLeafNode:
+		return inlineHeaderSize + l.bodySize + 4
+	case sharedLeafNode:
+		return sharedHeaderSize + l.preimageSize + 4
+	case chunkedLeafNode:
+		return chunkedSize(l.preimageSize, len(l.chunks))
+	}
 	return leafSize
 }
 
@@ -137,9 +337,12 @@ func (l *leaf) Marshal() []byte {
 	return buf
 }
 
-func (l *leaf) Allocate(store *store.FileStore) {
+// Allocate encodes the body and reserves an offset for the record. Body is encoded before the commit
+// as the type and the size of the record depend on it, and the type is written by the parent.
+func (l *leaf) Allocate(s store.Backend) {
 	if l.dirty {
-		l.idx, l.pos = store.TreeOffsetFor(l.Size())
+		l.encodeBody(s)
+		l.idx, l.pos = s.TreeOffsetFor(l.Size())
 	}
 }
 
@@ -149,7 +352,12 @@ func (l *leaf) MarshalTo(buf []byte) {
 	order.PutUint32(buf[32:], l.valueIdx)
 	order.PutUint32(buf[36:], l.valuePos)
 	order.PutUint32(buf[40:], uint32(len(l.preimage)))
-	order.PutUint32(buf[44:], uint32(len(l.value)))
+	if l.encoded {
+		// length of the encoded value
+		order.PutUint32(buf[44:], uint32(l.bodySize-len(l.preimage)-1))
+	} else {
+		order.PutUint32(buf[44:], uint32(len(l.value)))
+	}
 	putCrcSum32(buf[48:52], buf[:48])
 }
 
@@ -166,44 +374,134 @@ func (l *leaf) Unmarshal(buf []byte) error {
 	return nil
 }
 
-func (l *leaf) Commit(store *store.FileStore) error {
+// MarshalInline returns record with the body, used for inlineLeafNode.
+func (l *leaf) MarshalInline() []byte {
+	buf := make([]byte, l.Size())
+	copy(buf, l.key[:])
+	if l.encoded {
+		buf[32] = 1
+	}
+	order.PutUint16(buf[33:], uint16(len(l.preimage)))
+	order.PutUint16(buf[35:], uint16(l.bodySize))
+	copy(buf[inlineHeaderSize:], l.body)
+	putCrcSum32(buf[len(buf)-4:], buf[:len(buf)-4])
+	return buf
+}
+
+func (l *leaf) unmarshalInline(buf []byte) error {
+	_ = buf[l.Size()-1]
+	if crcSum32(buf[:len(buf)-4]) != order.Uint32(buf[len(buf)-4:]) {
+		return ErrCRC
+	}
+	copy(l.key[:], buf)
+	l.encoded = buf[32] == 1
+	l.keyLength = int(order.Uint16(buf[33:]))
+	l.bodySize = int(order.Uint16(buf[35:]))
+	l.valueIdx, l.valuePos = 0, 0
+	return nil
+}
+
+func (l *leaf) Commit(s store.Backend) error {
 	if !l.dirty {
 		return nil
 	}
-	idx, pos := store.ValueOffsetFor(len(l.preimage) + len(l.value) + 4)
-
-	bodylth := len(l.preimage) + len(l.value)
-	buf := make([]byte, len(l.preimage)+len(l.value)+4)
-	copy(buf, l.preimage)
-	copy(buf[len(l.preimage):], l.value)
-	putCrcSum32(buf[bodylth:bodylth+4], buf[:bodylth])
-	n, err := store.WriteValue(buf)
-	if err != nil {
+	if err := l.seal(s); err != nil {
 		return err
 	}
-	if n != len(buf) {
-		return errors.New("partial leaf body write")
+	for _, body := range l.place(s) {
+		n, err := s.WriteValue(body)
+		if err != nil {
+			return err
+		}
+		if n != len(body) {
+			return errors.New("partial leaf body write")
+		}
 	}
-
-	l.valueIdx = idx
-	l.valuePos = pos
-	n, err = store.WriteTree(l.Marshal())
+	buf := l.marshalRecord()
+	n, err := s.WriteTree(buf)
 	if err != nil {
 		return err
 	}
-	if n != l.Size() {
+	if n != len(buf) {
 		return errors.New("partial tree write")
 	}
-	l.dirty = false
+	l.committed()
 	return nil
 }
 
-func (l *leaf) Prove(store *store.FileStore, key [size]byte, proof *Proof) error {
+// seal encrypts bodies of the allocated leaf and appends crc to the bodies that are written to the value group.
+// It doesn't depend on offsets in the value group, therefore different leaves can be sealed concurrently.
+func (l *leaf) seal(s store.Backend) error {
+	if l.body == nil && l.preimageBody == nil {
+		return errors.New("leaf must be allocated before commit")
+	}
+	var err error
+	switch l.ntype {
+	case sharedLeafNode:
+		return l.sealShared(s)
+	case chunkedLeafNode:
+		return l.sealChunks(s)
+	case inlineLeafNode:
+		l.body, err = sealBody(store.ValueCipher(s), l.body, l.encoded, l.key[:])
+	default:
+		l.body, err = sealBody(store.ValueCipher(s), l.body, l.encoded, l.key[:])
+		l.body = appendCrc(l.body, l.bodySize)
+	}
+	return err
+}
+
+// place allocates offsets in the value group for the sealed bodies and returns bodies in the order
+// they must be written. Must be called in the same order as bodies are written.
+func (l *leaf) place(s store.Backend) [][]byte {
+	switch l.ntype {
+	case sharedLeafNode:
+		return l.placeShared(s)
+	case chunkedLeafNode:
+		return l.placeChunks(s)
+	case inlineLeafNode:
+		return nil
+	}
+	l.valueIdx, l.valuePos = s.ValueOffsetFor(len(l.body))
+	return [][]byte{l.body}
+}
+
+// marshalRecord returns the record of the placed leaf.
+func (l *leaf) marshalRecord() []byte {
+	switch l.ntype {
+	case sharedLeafNode:
+		return l.marshalShared(l.preimageBody)
+	case chunkedLeafNode:
+		return l.marshalChunked(l.preimageBody)
+	case inlineLeafNode:
+		return l.MarshalInline()
+	}
+	return l.Marshal()
+}
+
+// committed releases bodies after the leaf was written.
+func (l *leaf) committed() {
+	l.body, l.preimageBody, l.chunkBodies = nil, nil, nil
+	l.dirty = false
+}
+
+func (l *leaf) Prove(store store.Backend, key [size]byte, proof *Proof) error {
 	if err := l.sync(store); err != nil {
 		return err
 	}
 	if l.key == key {
-		proof.addValue(l.value)
+		if err := l.syncValue(store); err != nil {
+			return err
+		}
+		proof.addValue(copyBytes(l.value))
+		return nil
+	}
+	if l.written && l.value == nil {
+		// collision needs only the hash of the value
+		rst, err := l.hashChunks(store)
+		if err != nil {
+			return err
+		}
+		proof.addCollision(l.key[:], rst)
 		return nil
 	}
 	rst := sum(l.value)
@@ -211,13 +509,16 @@ func (l *leaf) Prove(store *store.FileStore, key [size]byte, proof *Proof) error
 	return nil
 }
 
-func (l *leaf) makeEntry(store *store.FileStore) (Entry, error) {
+func (l *leaf) makeEntry(store store.Backend) (Entry, error) {
 	if err := l.sync(store); err != nil {
 		return nil, err
 	}
+	if l.written && l.value == nil {
+		return chunkedEntry{store: store, leaf: l}, nil
+	}
 	return entry{
-		key:   l.preimage,
-		value: l.value,
+		key:   copyBytes(l.preimage),
+		value: copyBytes(l.value),
 	}, nil
 }
 
@@ -233,6 +534,20 @@ func (e entry) Value() ([]byte, error) {
 	return e.value, nil
 }
 
+// chunkedEntry reads chunks of the value only if the value is requested.
+type chunkedEntry struct {
+	store store.Backend
+	leaf  *leaf
+}
+
+func (e chunkedEntry) Key() ([]byte, error) {
+	return copyBytes(e.leaf.preimage), nil
+}
+
+func (e chunkedEntry) Value() ([]byte, error) {
+	return e.leaf.readChunks(e.store)
+}
+
 func leafHash(hkey, hvalue []byte) []byte {
 	rst := make([]byte, 0, 32)
 	h := hasher()
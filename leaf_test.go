@@ -1,9 +1,15 @@
 package urkeltrie
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/dshulyak/urkeltrie/store"
 	"github.com/stretchr/testify/require"
 )
 
@@ -56,3 +62,77 @@ func TestLeafBigValue(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, value, got)
 }
+
+func compressibleValue(i int) []byte {
+	return []byte(fmt.Sprintf(`{"nonce":%d,"balance":%d,"code":"","storage":"%s"}`, i, i*1000, strings.Repeat("00", 100)))
+}
+
+func TestValueCompression(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-value-compression-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	plain := setupFullTree(t, 0)
+	conf := store.DefaultConfig(tmp)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+
+	// values written before compression was enabled
+	keys := [][]byte{}
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		keys = append(keys, key)
+		require.NoError(t, tree.Put(key, compressibleValue(i)))
+		require.NoError(t, plain.Put(key, compressibleValue(i)))
+	}
+	require.NoError(t, tree.Commit())
+	require.NoError(t, plain.Commit())
+	var before store.Stats
+	st.ReadStats(&before)
+	require.NoError(t, st.Close())
+
+	conf.ValueCodec = store.Flate
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	for i := 100; i < 200; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		keys = append(keys, key)
+		require.NoError(t, tree.Put(key, compressibleValue(i)))
+		require.NoError(t, plain.Put(key, compressibleValue(i)))
+	}
+	// incompressible values are stored without encoding
+	random := make([]byte, 100)
+	rand.Read(random)
+	require.NoError(t, tree.Put(random, random))
+	require.NoError(t, plain.Put(random, random))
+	require.NoError(t, tree.Commit())
+	require.NoError(t, plain.Commit())
+	require.Equal(t, plain.Hash(), tree.Hash())
+
+	var after store.Stats
+	st.ReadStats(&after)
+	// 100 compressed values take less space than the 100 uncompressed
+	require.Less(t, after.Value.DiskSize-before.Value.DiskSize, before.Value.DiskSize/2)
+	require.NoError(t, st.Close())
+
+	conf.ValueCodec = nil
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, compressibleValue(i), val)
+	}
+	val, err := tree.Get(random)
+	require.NoError(t, err)
+	require.Equal(t, random, val)
+}
@@ -0,0 +1,57 @@
+package urkeltrie
+
+import "github.com/dshulyak/urkeltrie/store"
+
+// treeMetrics are updated by the tree and its snapshots.
+type treeMetrics struct {
+	commits     store.Timer
+	reads       store.Timer
+	written     store.Counter
+	lastWritten store.Gauge
+}
+
+// CollectMetrics reports metrics of the tree and of the backend, if it implements store.MetricsCollector.
+// Dirty nodes and the version are read from the tree, it must not be called concurrently with
+// modifications of the tree, SafeTree can be used instead.
+func (t *Tree) CollectMetrics(f func(store.Metric)) {
+	m := t.metrics
+	for _, metric := range []store.Metric{
+		m.commits.Metric("urkel_tree_commit_seconds", "Commits of the tree."),
+		m.reads.Metric("urkel_tree_get_seconds", "Reads of the values from the tree."),
+		m.written.Metric("urkel_tree_written_nodes_total", "Nodes written by commits and flushes."),
+		m.lastWritten.Metric("urkel_tree_last_written_nodes", "Nodes written by the last commit or flush."),
+		{
+			Name:  "urkel_tree_dirty_nodes",
+			Help:  "Nodes that were modified and not written yet.",
+			Kind:  store.GaugeMetric,
+			Value: countDirty(t.root),
+		},
+		{
+			Name:  "urkel_tree_version",
+			Help:  "Version of the tree.",
+			Kind:  store.GaugeMetric,
+			Value: t.version,
+		},
+	} {
+		f(metric)
+	}
+	if c, ok := t.store.(store.MetricsCollector); ok {
+		c.CollectMetrics(f)
+	}
+}
+
+// countDirty returns the number of dirty nodes in the subtree. Clean nodes don't have dirty children.
+func countDirty(n node) uint64 {
+	switch n := n.(type) {
+	case *inner:
+		if n == nil || !n.dirty {
+			return 0
+		}
+		return 1 + countDirty(n.left) + countDirty(n.right)
+	case *leaf:
+		if n.dirty {
+			return 1
+		}
+	}
+	return 0
+}
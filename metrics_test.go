@@ -0,0 +1,87 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func collectMetrics(c store.MetricsCollector) map[string]store.Metric {
+	rst := map[string]store.Metric{}
+	c.CollectMetrics(func(m store.Metric) {
+		rst[m.Name] = m
+	})
+	return rst
+}
+
+func TestMetrics(t *testing.T) {
+	st, err := store.Open(store.DefaultConfig(""))
+	require.NoError(t, err)
+	defer st.Close()
+	// stats are readable before the first commit
+	var stats store.Stats
+	st.ReadStats(&stats)
+
+	tree := NewTree(st)
+	keys := make([][]byte, 10)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+		require.NoError(t, tree.Put(keys[i], keys[i]))
+	}
+	metrics := collectMetrics(tree)
+	require.NotZero(t, metrics["urkel_tree_dirty_nodes"].Value)
+	dirty := metrics["urkel_tree_dirty_nodes"].Value
+
+	require.NoError(t, tree.Commit())
+	for _, key := range keys {
+		_, err := tree.Get(key)
+		require.NoError(t, err)
+	}
+
+	metrics = collectMetrics(tree)
+	require.Equal(t, uint64(1), metrics["urkel_tree_commit_seconds"].Value)
+	require.NotZero(t, metrics["urkel_tree_commit_seconds"].Total)
+	require.Equal(t, dirty, metrics["urkel_tree_last_written_nodes"].Value)
+	require.Equal(t, dirty, metrics["urkel_tree_written_nodes_total"].Value)
+	require.Zero(t, metrics["urkel_tree_dirty_nodes"].Value)
+	require.Equal(t, uint64(1), metrics["urkel_tree_version"].Value)
+	require.Equal(t, uint64(len(keys)), metrics["urkel_tree_get_seconds"].Value)
+
+	require.Equal(t, uint64(1), metrics["urkel_store_commit_seconds"].Value)
+	require.Equal(t, uint64(1), metrics["urkel_store_tree_fsync_seconds"].Value)
+	require.Equal(t, uint64(versionSize), metrics["urkel_store_version_written_bytes_total"].Value)
+	leaves := uint64(len(keys))
+	require.Equal(t, (dirty-leaves)*innerSize+leaves*leafSize, metrics["urkel_store_tree_written_bytes_total"].Value)
+	require.NotZero(t, metrics["urkel_store_value_written_bytes_total"].Value)
+	// nodes are read once from disk and served from the cache afterwards
+	hits, misses := metrics["urkel_store_cache_hits_total"].Value, metrics["urkel_store_cache_misses_total"].Value
+	require.NotZero(t, misses)
+	require.Equal(t, misses, metrics["urkel_store_tree_read_seconds"].Value)
+	require.NotZero(t, hits)
+
+	var buf bytes.Buffer
+	require.NoError(t, store.WriteMetricsText(&buf, tree))
+	text := buf.String()
+	require.Contains(t, text, "# TYPE urkel_tree_version gauge\nurkel_tree_version 1\n")
+	require.Contains(t, text, "# TYPE urkel_tree_commit_seconds summary\n")
+	require.Contains(t, text, "urkel_tree_commit_seconds_count 1\n")
+	require.Contains(t, text, "# TYPE urkel_store_version_written_bytes_total counter\n")
+
+	store.PublishMetrics("urkel_test_metrics", tree)
+	published := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("urkel_test_metrics").String()), &published))
+	require.Equal(t, "1", string(published["urkel_tree_version"]))
+	timer := struct {
+		Count uint64
+		Sum   float64
+	}{}
+	require.NoError(t, json.Unmarshal(published["urkel_tree_commit_seconds"], &timer))
+	require.Equal(t, uint64(1), timer.Count)
+	require.NotZero(t, timer.Sum)
+}
@@ -0,0 +1,181 @@
+package urkeltrie
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// operations in the log
+const (
+	// commitOp separates operations that were committed in the version from the following operations
+	commitOp byte = iota
+	putOp
+	deleteOp
+)
+
+// logPut appends put operation to the log: key, preimage size, preimage and value.
+func (t *Tree) logPut(key [size]byte, preimage, value []byte) error {
+	if t.oplog == nil {
+		return nil
+	}
+	op := append(t.opbuf[:0], putOp)
+	op = append(op, key[:]...)
+	op = appendUvarint(op, uint64(len(preimage)))
+	op = append(op, preimage...)
+	op = append(op, value...)
+	return t.appendOp(op)
+}
+
+func (t *Tree) logDelete(key [size]byte) error {
+	if t.oplog == nil {
+		return nil
+	}
+	op := append(t.opbuf[:0], deleteOp)
+	op = append(op, key[:]...)
+	return t.appendOp(op)
+}
+
+// logCommit marks operations that were appended before as committed in the version.
+func (t *Tree) logCommit(version uint64) error {
+	if t.oplog == nil {
+		return nil
+	}
+	op := append(t.opbuf[:0], commitOp)
+	op = append(op, make([]byte, 8)...)
+	order.PutUint64(op[1:], version)
+	return t.appendOp(op)
+}
+
+// appendOp appends the operation to the log. Operations contain preimages and values, therefore
+// they are sealed with the same key if the store encrypts values.
+func (t *Tree) appendOp(op []byte) error {
+	t.opbuf = op
+	aead := store.ValueCipher(t.store)
+	if aead == nil {
+		return t.oplog.Append(op)
+	}
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(op)+aead.Overhead())
+	if _, err := rand.Read(sealed); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return t.oplog.Append(aead.Seal(sealed, sealed, op, nil))
+}
+
+// openOp authenticates and decrypts the operation if the store encrypts values.
+func (t *Tree) openOp(record []byte) ([]byte, error) {
+	aead := store.ValueCipher(t.store)
+	if aead == nil {
+		return record, nil
+	}
+	if len(record) < aead.NonceSize() {
+		return nil, ErrAuthentication
+	}
+	op, err := aead.Open(nil, record[:aead.NonceSize()], record[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthentication, err)
+	}
+	return op, nil
+}
+
+// committedOps is called after the version is committed. Log is truncated if the version is durable,
+// otherwise logged operations may be needed to restore the version after crash and the log is marked.
+func (t *Tree) committedOps() error {
+	if t.oplog == nil {
+		return nil
+	}
+	if t.DurableVersion() >= t.version {
+		return t.oplog.Truncate()
+	}
+	return t.logCommit(t.version)
+}
+
+// loadedOps is called after the tree was loaded. On the first load of the latest version operations
+// that are not in the version are applied to the tree, otherwise they are discarded together with the dirty state.
+func (t *Tree) loadedOps(latest bool) error {
+	if t.oplog == nil {
+		return nil
+	}
+	if !latest || t.replayed {
+		return t.oplog.Truncate()
+	}
+	t.replayed = true
+	return t.replayOps()
+}
+
+// replayOps applies operations that follow the last commit marker with the version that is not newer
+// than the loaded version. Operations before such marker are already in the loaded version.
+// Operations that are committed in the versions lost on crash are applied again, replaying the
+// same sequence of puts and deletes twice results in the same state.
+func (t *Tree) replayOps() error {
+	var skip, i int
+	if err := t.oplog.Replay(func(record []byte) error {
+		i++
+		op, err := t.openOp(record)
+		if err != nil {
+			return err
+		}
+		if len(op) > 0 && op[0] == commitOp && len(op) == 9 && order.Uint64(op[1:]) <= t.version {
+			skip = i
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	i = 0
+	return t.oplog.Replay(func(record []byte) error {
+		i++
+		if i <= skip {
+			return nil
+		}
+		op, err := t.openOp(record)
+		if err != nil {
+			return err
+		}
+		return t.applyOp(op)
+	})
+}
+
+var errInvalidOp = errors.New("invalid operation in the log")
+
+func (t *Tree) applyOp(op []byte) error {
+	if len(op) == 0 {
+		return errInvalidOp
+	}
+	switch op[0] {
+	case commitOp:
+		return nil
+	case deleteOp:
+		if len(op) != 1+size {
+			return fmt.Errorf("%w: delete of %d bytes", errInvalidOp, len(op))
+		}
+		var key [size]byte
+		copy(key[:], op[1:])
+		_, err := t.delete(key)
+		return err
+	case putOp:
+		if len(op) < 1+size {
+			return fmt.Errorf("%w: put of %d bytes", errInvalidOp, len(op))
+		}
+		var key [size]byte
+		copy(key[:], op[1:])
+		preimageSize, n := binary.Uvarint(op[1+size:])
+		if n <= 0 || uint64(len(op)-1-size-n) < preimageSize {
+			return fmt.Errorf("%w: put with invalid preimage", errInvalidOp)
+		}
+		rest := op[1+size+n:]
+		// op may be reused by the log, tree keeps preimage and value in memory
+		rest = append([]byte{}, rest...)
+		return t.put(key, rest[:preimageSize:preimageSize], rest[preimageSize:])
+	}
+	return fmt.Errorf("%w: unknown type %d", errInvalidOp, op[0])
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
@@ -0,0 +1,159 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+// putRandom puts random keys into both trees and deletes every third of them.
+func putRandom(t *testing.T, tree, plain *Tree, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key, value := make([]byte, 10), make([]byte, 20)
+		rand.Read(key)
+		rand.Read(value)
+		require.NoError(t, tree.Put(key, value))
+		require.NoError(t, plain.Put(key, value))
+		if i%3 == 0 {
+			require.NoError(t, tree.Delete(key))
+			require.NoError(t, plain.Delete(key))
+		}
+	}
+}
+
+func TestOpLogReplay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-oplog-replay-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.OpLog = true
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	plain := setupFullTree(t, 0)
+
+	putRandom(t, tree, plain, 50)
+	require.NoError(t, tree.Commit())
+	require.NoError(t, plain.Commit())
+	logPath := filepath.Join(tmp, "oplog-0.udb")
+	info, err := os.Stat(logPath)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	putRandom(t, tree, plain, 50)
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.NoError(t, st.Close())
+	appendGarbage(t, logPath, 10)
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(1), tree.Version())
+	require.Equal(t, plain.Hash(), tree.Hash())
+
+	// operations are replayed only once, following loads discard them
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(1), tree.Version())
+	require.NotEqual(t, plain.Hash(), tree.Hash())
+	info, err = os.Stat(logPath)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+}
+
+func TestOpLogRelaxedCommits(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-oplog-relaxed-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.OpLog = true
+	conf.Durability = store.DurabilityNone
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	plain := setupFullTree(t, 0)
+
+	putRandom(t, tree, plain, 30)
+	require.NoError(t, tree.Commit())
+	require.NoError(t, st.Sync())
+	for i := 0; i < 2; i++ {
+		putRandom(t, tree, plain, 30)
+		require.NoError(t, tree.Commit())
+	}
+	rst := tree.CommitAsync()
+	putRandom(t, tree, plain, 30)
+	require.NoError(t, (<-rst).Err)
+	putRandom(t, tree, plain, 30)
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.NoError(t, st.Close())
+
+	// last two versions were not durable and are lost
+	truncateTail(t, filepath.Join(tmp, "version-0.udb"), 2*versionSize)
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(2), tree.Version())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.NoError(t, tree.Commit())
+	require.Equal(t, plain.Hash(), tree.Hash())
+}
+
+func TestOpLogEncrypted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-oplog-encrypted-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.OpLog = true
+	conf.EncryptionKey = make([]byte, 16)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+
+	key, value := []byte("plain key"), []byte("plain value")
+	require.NoError(t, tree.Put(key, value))
+	require.NoError(t, st.Close())
+
+	logPath := filepath.Join(tmp, "oplog-0.udb")
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.NotEmpty(t, data)
+	require.False(t, bytes.Contains(data, key))
+	require.False(t, bytes.Contains(data, value))
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	got, err := tree.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+	require.NoError(t, st.Close())
+
+	// record with the correct crc but modified ciphertext is rejected
+	data[20] ^= 1
+	putCrcSum32(data[len(data)-4:], data[:len(data)-4])
+	require.NoError(t, ioutil.WriteFile(logPath, data, 0o644))
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	err = tree.LoadLatest()
+	require.True(t, errors.Is(err, ErrAuthentication), "error: %v", err)
+}
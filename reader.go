@@ -0,0 +1,266 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// size of the block that is used to check crc of the body without loading it into memory
+const verifyBlockSize = 64 << 10
+
+// GetReader returns reader for the value of the key and the size of the value.
+// Chunked and plain values are read from the store on demand, other values are loaded into memory.
+func (t *Tree) GetReader(key []byte) (io.ReaderAt, int64, error) {
+	return t.GetReaderRaw(sum(key))
+}
+
+func (t *Tree) GetReaderRaw(key [size]byte) (io.ReaderAt, int64, error) {
+	if t.root == nil {
+		return nil, 0, fmt.Errorf("%w: key %x", ErrNotFound, key)
+	}
+	defer t.metrics.reads.Since(time.Now())
+	l, err := t.root.getLeaf(t.store, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return l.reader(t.store, key)
+}
+
+// PutReader reads the value of the size from r and inserts it into the tree. Value that is larger
+// than the chunk size of the store is written to the store in chunks without being loaded into memory.
+func (t *Tree) PutReader(key []byte, r io.Reader, size int64) error {
+	return t.PutReaderRaw(sum(key), key, r, size)
+}
+
+func (t *Tree) PutReaderRaw(key [size]byte, preimage []byte, r io.Reader, valueSize int64) error {
+	if valueSize < 0 {
+		return fmt.Errorf("invalid value size %d", valueSize)
+	}
+	chunkSize := store.ValueChunkSize(t.store)
+	if valueSize <= int64(chunkSize) || (chunkSize == 0 && valueSize <= int64(maxValueSize)) {
+		value := make([]byte, valueSize)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return fmt.Errorf("failed to read the value: %w", err)
+		}
+		return t.PutRaw(key, preimage, value)
+	}
+	if chunkSize == 0 {
+		return fmt.Errorf("value is longer then max allowed, %d > %d", valueSize, maxValueSize)
+	}
+	// chunks are written to the store right away
+	if err := t.waitCommits(); err != nil {
+		return err
+	}
+	leaf := newLeaf(key, preimage, nil)
+	if err := leaf.writeChunks(t.store, r, valueSize, chunkSize); err != nil {
+		return err
+	}
+	if t.root == nil {
+		t.root = newInner(0)
+	}
+	return t.root.Insert(t.store, leaf)
+}
+
+// getLeaf returns the leaf on the path of the key without loading its body.
+func (in *inner) getLeaf(store store.Backend, key [size]byte) (*leaf, error) {
+	if err := in.sync(store); err != nil {
+		return nil, err
+	}
+	defer in.reset()
+	child, side := in.left, "left"
+	if bitSet(key, in.bit) {
+		child, side = in.right, "right"
+	}
+	switch n := child.(type) {
+	case *inner:
+		return n.getLeaf(store, key)
+	case *leaf:
+		return n, nil
+	}
+	return nil, fmt.Errorf("%w: %s dead end at %d. key %x", ErrNotFound, side, in.bit, key)
+}
+
+// reader returns reader for the value of the leaf. Plain and chunked bodies are read on demand,
+// only records are read from the tree group.
+func (l *leaf) reader(s store.Backend, key [size]byte) (io.ReaderAt, int64, error) {
+	if !l.synced && !l.dirty {
+		var (
+			_, cached = store.CachedNode(s, l.idx, l.pos)
+			err       error
+		)
+		switch {
+		case !cached && l.ntype == leafNode:
+			err = l.readRecord(s)
+		case !cached && l.ntype == chunkedLeafNode:
+			err = l.readChunkedRecord(s)
+		default:
+			err = l.sync(s)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if l.key != key {
+		return nil, 0, fmt.Errorf("%w: collision, key %x not found", ErrNotFound, key)
+	}
+	switch {
+	case l.written:
+		return newChunksReader(s, l), int64(l.valueSize), nil
+	case l.dirty || l.synced:
+		return bytes.NewReader(l.value), int64(len(l.value)), nil
+	case l.ntype == chunkedLeafNode:
+		return newChunksReader(s, l), int64(l.valueSize), nil
+	}
+	return &bodyReader{
+		store:    s,
+		idx:      l.valueIdx,
+		pos:      l.valuePos,
+		offset:   l.keyLength,
+		bodySize: l.bodySize,
+	}, int64(l.valueLength), nil
+}
+
+// bodyReader reads the value from the body that is not encoded. Crc of the whole body is checked
+// on the first read, the body is not kept in memory.
+type bodyReader struct {
+	store    store.Backend
+	idx, pos uint32
+	// offset of the value in the body
+	offset   int
+	bodySize int
+
+	once sync.Once
+	err  error
+}
+
+func (r *bodyReader) ReadAt(buf []byte, off int64) (int, error) {
+	r.once.Do(func() {
+		r.err = r.verify()
+	})
+	if r.err != nil {
+		return 0, r.err
+	}
+	size := int64(r.bodySize - r.offset)
+	if off < 0 || off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := size - off; int64(len(buf)) > rest {
+		buf, eof = buf[:rest], io.EOF
+	}
+	n, err := r.store.ReadValueAt(r.idx, r.pos+uint32(r.offset)+uint32(off), buf)
+	if n == len(buf) {
+		return n, eof
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, fmt.Errorf("failed to load value at %d:%d. error %w", r.idx, r.pos, err)
+}
+
+// verify reads the body with crc in blocks and checks crc.
+func (r *bodyReader) verify() error {
+	var (
+		crc   uint32
+		block = make([]byte, verifyBlockSize)
+		total = r.bodySize + 4
+	)
+	for read := 0; read < total; {
+		buf := block
+		if rest := total - read; rest < len(buf) {
+			buf = buf[:rest]
+		}
+		n, err := r.store.ReadValueAt(r.idx, r.pos+uint32(read), buf)
+		if n != len(buf) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("failed to load value at %d:%d. error %w", r.idx, r.pos, err)
+		}
+		body := buf
+		if read+len(buf) > r.bodySize {
+			body = buf[:r.bodySize-read]
+		}
+		crc = crc32.Update(crc, crcTable, body)
+		read += len(buf)
+		if read == total {
+			if crc != order.Uint32(buf[len(buf)-4:]) {
+				return fmt.Errorf("%w: leaf value at %d:%d", ErrCRC, r.idx, r.pos)
+			}
+		}
+	}
+	return nil
+}
+
+func newChunksReader(s store.Backend, l *leaf) *chunksReader {
+	return &chunksReader{
+		store:     s,
+		key:       l.key,
+		chunks:    l.chunks,
+		chunkSize: l.chunkSize,
+		size:      int64(l.valueSize),
+		last:      -1,
+	}
+}
+
+// chunksReader reads and decodes chunks of the value on demand. Every chunk is checked against its crc
+// when it is read, the last read chunk is kept in memory.
+type chunksReader struct {
+	store     store.Backend
+	key       [size]byte
+	chunks    []chunkRef
+	chunkSize int
+	size      int64
+
+	mu    sync.Mutex
+	last  int
+	chunk []byte
+}
+
+func (r *chunksReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 || off >= r.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(buf) && off < r.size {
+		i := int(off / int64(r.chunkSize))
+		chunk, err := r.get(i)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(buf[n:], chunk[off-int64(i*r.chunkSize):])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *chunksReader) get(i int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == i {
+		return r.chunk, nil
+	}
+	chunk, err := readChunk(r.store, r.key, r.chunks[i], i)
+	if err != nil {
+		return nil, err
+	}
+	expected := r.chunkSize
+	if rest := r.size - int64(i*r.chunkSize); rest < int64(expected) {
+		expected = int(rest)
+	}
+	if len(chunk) != expected {
+		return nil, fmt.Errorf("chunk %d has %d bytes, expected %d", i, len(chunk), expected)
+	}
+	r.last, r.chunk = i, chunk
+	return chunk, nil
+}
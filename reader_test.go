@@ -0,0 +1,182 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, r io.ReaderAt, size int64) []byte {
+	t.Helper()
+	buf, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	require.NoError(t, err)
+	return buf
+}
+
+func TestStreamingValues(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		conf func(*store.Config)
+	}{
+		{"plain", func(*store.Config) {}},
+		{"encoded", func(conf *store.Config) {
+			conf.ValueCodec = store.Flate
+			conf.EncryptionKey = make([]byte, 16)
+		}},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-streaming-values-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			conf.MaxFileSize = 4096
+			conf.ValueChunkSize = 1000
+			tc.conf(&conf)
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			tree := NewTree(st)
+			plain := setupFullTree(t, 0)
+
+			values := map[string][]byte{}
+			for _, lth := range []int{0, 10, 1000, 1001, 3500} {
+				key := make([]byte, 10)
+				rand.Read(key)
+				value := make([]byte, lth)
+				rand.Read(value)
+				values[string(key)] = value
+				require.NoError(t, tree.PutReader(key, bytes.NewReader(value), int64(lth)))
+				require.NoError(t, plain.Put(key, value))
+			}
+			require.Equal(t, plain.Hash(), tree.Hash())
+			for key, value := range values {
+				r, size, err := tree.GetReader([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, int64(len(value)), size)
+				require.Equal(t, value, readAll(t, r, size))
+			}
+			require.NoError(t, tree.Commit())
+			require.NoError(t, plain.Commit())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			require.NoError(t, st.Close())
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			defer st.Close()
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.Equal(t, plain.Hash(), tree.Hash())
+			for key, value := range values {
+				r, size, err := tree.GetReader([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, int64(len(value)), size)
+				require.Equal(t, value, readAll(t, r, size))
+				if size > 20 {
+					part := make([]byte, 20)
+					n, err := r.ReadAt(part, size-10)
+					require.Equal(t, io.EOF, err)
+					require.Equal(t, 10, n)
+					require.Equal(t, value[size-10:], part[:n])
+				}
+				got, err := tree.Get([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, value, got)
+			}
+		})
+	}
+}
+
+func TestPutReaderOverwrite(t *testing.T) {
+	conf := store.DefaultConfig("")
+	conf.ValueChunkSize = 100
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+
+	key := []byte("key")
+	first, second := make([]byte, 250), make([]byte, 10)
+	rand.Read(first)
+	rand.Read(second)
+	require.NoError(t, tree.Put(key, second))
+	require.NoError(t, tree.PutReader(key, bytes.NewReader(first), int64(len(first))))
+	got, err := tree.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+
+	require.NoError(t, tree.Put(key, second))
+	got, err = tree.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, second, got)
+
+	require.Error(t, tree.PutReader(key, bytes.NewReader(first[:50]), int64(len(first))))
+}
+
+func TestPutReaderOverwriteEmpty(t *testing.T) {
+	conf := store.DefaultConfig("")
+	conf.ValueChunkSize = 100
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	plain := setupFullTree(t, 0)
+
+	key := []byte("key")
+	value := make([]byte, 1000)
+	rand.Read(value)
+	require.NoError(t, tree.PutReader(key, bytes.NewReader(value), int64(len(value))))
+	require.NoError(t, plain.Put(key, value))
+	// record of the leaf is pinned until the commit is finished
+	rst := tree.CommitAsync()
+	require.NoError(t, tree.Put(key, []byte{}))
+	require.NoError(t, plain.Put(key, []byte{}))
+	got, err := tree.Get(key)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	require.NoError(t, (<-rst).Err)
+
+	require.NoError(t, tree.Commit())
+	require.NoError(t, plain.Commit())
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.NoError(t, tree.LoadLatest())
+	got, err = tree.Get(key)
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestGetReaderCorrupted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-reader-corrupted-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	key, value := []byte("key"), make([]byte, 100)
+	rand.Read(value)
+	require.NoError(t, tree.Put(key, value))
+	require.NoError(t, tree.Commit())
+	require.NoError(t, st.Close())
+
+	corruptFile(t, filepath.Join(tmp, "value-0.udb"), 0, func(buf []byte) {
+		buf[0] ^= 0xff
+	})
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	r, size, err := tree.GetReader(key)
+	require.NoError(t, err)
+	_, err = r.ReadAt(make([]byte, 1), size-1)
+	require.True(t, errors.Is(err, ErrCRC), "%v", err)
+}
@@ -1,11 +1,36 @@
 package urkeltrie
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
 
 type SafeTree struct {
 	mu   sync.Mutex // this is temporary, concurrency will be adressed separately
 	tree *Tree
 	// TODO it should copy values that are kept in tree's memory
+
+	// compaction that couldn't be finished because tree had uncommitted changes, see Compact
+	compaction *Compaction
+	compacted  chan error
+}
+
+// finishCompaction switches to the new generation if compaction is pending and tree has no uncommitted changes.
+// Must be called with the lock.
+func (s *SafeTree) finishCompaction() {
+	if s.compaction == nil {
+		return
+	}
+	err := s.tree.FinishCompaction(context.Background(), s.compaction)
+	if errors.Is(err, ErrDirtyTree) {
+		return
+	}
+	s.compacted <- err
+	s.compaction, s.compacted = nil, nil
 }
 
 func (s *SafeTree) Get(key []byte) ([]byte, error) {
@@ -20,6 +45,18 @@ func (s *SafeTree) Put(key, value []byte) error {
 	return s.tree.Put(key, value)
 }
 
+func (s *SafeTree) GetReader(key []byte) (io.ReaderAt, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.GetReader(key)
+}
+
+func (s *SafeTree) PutReader(key []byte, r io.Reader, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.PutReader(key, r, size)
+}
+
 func (s *SafeTree) GenerateProof(key []byte, proof *Proof) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -29,9 +66,24 @@ func (s *SafeTree) GenerateProof(key []byte, proof *Proof) error {
 func (s *SafeTree) Commit() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	defer s.finishCompaction()
 	return s.tree.Commit()
 }
 
+func (s *SafeTree) CommitWithMeta(meta []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.finishCompaction()
+	return s.tree.CommitWithMeta(meta)
+}
+
+func (s *SafeTree) CommitAsync() <-chan CommitResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.finishCompaction()
+	return s.tree.CommitAsync()
+}
+
 func (s *SafeTree) Hash() []byte {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -41,21 +93,42 @@ func (s *SafeTree) Hash() []byte {
 func (s *SafeTree) LoadLatest() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	defer s.finishCompaction()
 	return s.tree.LoadLatest()
 }
 
 func (s *SafeTree) LoadVersion(version uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	defer s.finishCompaction()
 	return s.tree.LoadVersion(version)
 }
 
+func (s *SafeTree) Rollback(version uint64, truncate bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.finishCompaction()
+	return s.tree.Rollback(version, truncate)
+}
+
 func (s *SafeTree) Version() uint64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.tree.Version()
 }
 
+func (s *SafeTree) DurableVersion() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.DurableVersion()
+}
+
+func (s *SafeTree) VersionMeta(version uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.VersionMeta(version)
+}
+
 func (s *SafeTree) Snapshot() Snapshot {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -67,3 +140,73 @@ func (s *SafeTree) VersionSnapshot(version uint64) (Snapshot, error) {
 	defer s.mu.Unlock()
 	return s.tree.VersionSnapshot(version)
 }
+
+func (s *SafeTree) SnapshotByRoot(hash []byte) (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.SnapshotByRoot(hash)
+}
+
+func (s *SafeTree) PruneVersions(upTo uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.PruneVersions(upTo)
+}
+
+// Compact copies live data into a new generation of files without blocking writers.
+// Lock is held only to start compaction and to switch to the new generation. If tree has uncommitted
+// changes the switch is done by the next commit, which copies versions committed meanwhile.
+func (s *SafeTree) Compact(ctx context.Context, opts CompactionOptions) error {
+	s.mu.Lock()
+	c, err := s.tree.StartCompaction(opts)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.Run(ctx); err != nil {
+		_ = c.Abort()
+		return err
+	}
+	s.mu.Lock()
+	err = s.tree.FinishCompaction(ctx, c)
+	if !errors.Is(err, ErrDirtyTree) {
+		s.mu.Unlock()
+		return err
+	}
+	// switch is done by the next commit, versions committed meanwhile are copied with the lock
+	compacted := make(chan error, 1)
+	s.compaction, s.compacted = c, compacted
+	s.mu.Unlock()
+	select {
+	case err := <-compacted:
+		return err
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.compaction != c {
+		return <-compacted
+	}
+	s.compaction, s.compacted = nil, nil
+	_ = c.Abort()
+	return ctx.Err()
+}
+
+func (s *SafeTree) Export(version uint64, w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Export(version, w)
+}
+
+func (s *SafeTree) Import(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.finishCompaction()
+	return s.tree.Import(r)
+}
+
+func (s *SafeTree) CollectMetrics(f func(store.Metric)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree.CollectMetrics(f)
+}
@@ -0,0 +1,158 @@
+package store
+
+import "io"
+
+// Backend is a storage for tree nodes, values and version records.
+//
+// Tree and value records are written in the same order as offsets were allocated for them.
+// Written data becomes durable on Commit. WriteTree and WriteValue are not called concurrently, unless
+// backend implements ConcurrentWriter.
+type Backend interface {
+	TreeOffsetFor(size int) (uint32, uint32)
+	ValueOffsetFor(size int) (uint32, uint32)
+
+	WriteTree(buf []byte) (int, error)
+	WriteValue(buf []byte) (int, error)
+	ReadTreeAt(index, off uint32, buf []byte) (int, error)
+	ReadValueAt(index, off uint32, buf []byte) (int, error)
+
+	WriteVersion(buf []byte) (int, error)
+	ReadVersion(version uint64, buf []byte) (int, error)
+	// ReadLastVersion reads nothing if there are no versions.
+	ReadLastVersion(buf []byte) (int, error)
+
+	// Flush writes buffered data without making it durable.
+	Flush() error
+	// Commit makes all written data durable.
+	Commit() error
+}
+
+// NodeCache is implemented by backends that cache decoded tree nodes.
+type NodeCache interface {
+	CachedNode(index, off uint32) (interface{}, bool)
+	CacheNode(index, off uint32, node interface{}, size int)
+}
+
+// NodePinner is implemented by backends that keep decoded nodes in memory until they are unpinned.
+// Pinned node is returned by CachedNode, it is used for nodes that are not written yet.
+type NodePinner interface {
+	PinNode(index, off uint32, node interface{})
+	UnpinNode(index, off uint32)
+}
+
+// TreeViewer is implemented by backends that can return tree records without copying them.
+type TreeViewer interface {
+	ViewTreeAt(index, off uint32, size int, f func([]byte) error) error
+}
+
+// Pruner is implemented by backends that support version pruning.
+type Pruner interface {
+	PruneVersions(upTo uint64) error
+	RetentionLimit(last uint64) uint64
+}
+
+// ValueInliner is implemented by backends that store small values together with tree records.
+type ValueInliner interface {
+	InlineValueSize() int
+}
+
+// ValueChunker is implemented by backends that store large values in chunks.
+type ValueChunker interface {
+	ValueChunkSize() int
+}
+
+// DurabilityReporter is implemented by backends that may commit without making data durable.
+type DurabilityReporter interface {
+	DurableVersion() uint64
+}
+
+// ConcurrentWriter is implemented by backends that allow to call WriteTree and WriteValue from different
+// goroutines at the same time. Writes to the same group are never concurrent.
+type ConcurrentWriter interface {
+	ConcurrentWrites() bool
+}
+
+var (
+	_ Backend            = (*FileStore)(nil)
+	_ NodeCache          = (*FileStore)(nil)
+	_ TreeViewer         = (*FileStore)(nil)
+	_ Pruner             = (*FileStore)(nil)
+	_ ValueEncoder       = (*FileStore)(nil)
+	_ ValueEncrypter     = (*FileStore)(nil)
+	_ ValueInliner       = (*FileStore)(nil)
+	_ ValueDeduplicator  = (*FileStore)(nil)
+	_ MetricsCollector   = (*FileStore)(nil)
+	_ ValueChunker       = (*FileStore)(nil)
+	_ NodePinner         = (*FileStore)(nil)
+	_ DurabilityReporter = (*FileStore)(nil)
+	_ OpLogger           = (*FileStore)(nil)
+	_ Rollbacker         = (*FileStore)(nil)
+	_ VersionMetaStore   = (*FileStore)(nil)
+	_ RootIndex          = (*FileStore)(nil)
+	_ ConcurrentWriter   = (*FileStore)(nil)
+)
+
+// ViewTree calls f with size bytes from the tree group. If backend implements TreeViewer the slice
+// must not be modified or retained after f returns.
+func ViewTree(b Backend, index, off uint32, size int, f func([]byte) error) error {
+	if v, ok := b.(TreeViewer); ok {
+		return v.ViewTreeAt(index, off, size, f)
+	}
+	buf := make([]byte, size)
+	n, err := b.ReadTreeAt(index, off, buf)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return f(buf)
+}
+
+// CachedNode returns decoded node if backend implements NodeCache and the node is cached.
+func CachedNode(b Backend, index, off uint32) (interface{}, bool) {
+	if c, ok := b.(NodeCache); ok {
+		return c.CachedNode(index, off)
+	}
+	return nil, false
+}
+
+// CacheNode adds decoded node to the cache if backend implements NodeCache.
+func CacheNode(b Backend, index, off uint32, node interface{}, size int) {
+	if c, ok := b.(NodeCache); ok {
+		c.CacheNode(index, off, node, size)
+	}
+}
+
+// maxInlineValueSize is the limit of the inline body size, it is stored as uint16.
+const maxInlineValueSize = 1<<16 - 1
+
+// InlineValueSize returns the maximum size of the value that is stored together with the tree record.
+// Zero if backend doesn't support inlining.
+func InlineValueSize(b Backend) int {
+	i, ok := b.(ValueInliner)
+	if !ok {
+		return 0
+	}
+	if size := i.InlineValueSize(); size < maxInlineValueSize {
+		return size
+	}
+	return maxInlineValueSize
+}
+
+// ValueChunkSize returns the size of the chunk, values that are larger are stored in chunks.
+// Zero if backend doesn't support chunks.
+func ValueChunkSize(b Backend) int {
+	if c, ok := b.(ValueChunker); ok {
+		return c.ValueChunkSize()
+	}
+	return 0
+}
+
+// ConcurrentWrites returns true if tree and value groups of the backend can be written concurrently.
+func ConcurrentWrites(b Backend) bool {
+	if c, ok := b.(ConcurrentWriter); ok {
+		return c.ConcurrentWrites()
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// approximate memory used by an entry in cache without a node
+const cacheEntryOverhead = 64
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		lru:     list.New(),
+		entries: map[uint64]*list.Element{},
+	}
+}
+
+type cacheEntry struct {
+	key  uint64
+	node interface{}
+	size int
+}
+
+// cache is a size bounded lru cache for decoded nodes, keyed by the position of the node.
+// It is safe to use from multiple goroutines.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	lru     *list.List
+	entries map[uint64]*list.Element
+
+	hits, misses uint64
+}
+
+func (c *cache) Get(idx, pos uint32) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, exist := c.entries[cacheKey(idx, pos)]
+	if !exist {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).node, true
+}
+
+func (c *cache) Add(idx, pos uint32, node interface{}, size int) {
+	size += cacheEntryOverhead
+	if size > c.size {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(idx, pos)
+	if elem, exist := c.entries[key]; exist {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	for c.used+size > c.size {
+		c.evict(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, node: node, size: size})
+	c.used += size
+}
+
+func (c *cache) evict(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
+
+// Purge removes all entries. Must be called if positions of the nodes are changed.
+func (c *cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = map[uint64]*list.Element{}
+	c.used = 0
+}
+
+func (c *cache) ReadStats(stats *GroupStats) {
+	stats.CacheHit += atomic.LoadUint64(&c.hits)
+	stats.CacheMiss += atomic.LoadUint64(&c.misses)
+}
+
+func cacheKey(idx, pos uint32) uint64 {
+	return uint64(idx)<<32 | uint64(pos)
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// Checkpoint creates a copy of the store in the directory at the latest commit. Files that are not written
+// anymore are hard linked if possible, the rest is copied up to the committed offsets.
+// Checkpoint can be created while the store keeps committing, but not concurrently with the generation switch.
+// Directory must be empty or not exist. Checkpoint can be opened as a regular store.
+func (s *FileStore) Checkpoint(dir string) error {
+	record, found, err := s.lastCommit()
+	if err != nil {
+		return err
+	}
+	if !found && s.versionOffset.Size() > 0 {
+		return errors.New("store doesn't have commit records, commit before creating a checkpoint")
+	}
+	fs := afero.NewOsFs()
+	names, err := afero.ReadDir(fs, dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("checkpoint directory %s is not empty", dir)
+	}
+	dst, err := OpenDir(fs, dir)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	for _, group := range []struct {
+		prefix        string
+		index, offset uint32
+	}{
+		{treePrefix, record.treeIndex, record.treeOffset},
+		{valuePrefix, record.valueIndex, record.valueOffset},
+	} {
+		for i := uint32(0); i < group.index; i++ {
+			if err := s.linkFile(dst, group.prefix, i); err != nil {
+				return err
+			}
+		}
+		if group.offset > 0 {
+			if err := s.copyFile(dst, group.prefix, group.index, int64(group.offset)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.copyFile(dst, versionPrefix, 0, int64(record.versionOffset)); err != nil {
+		return err
+	}
+	metaSize := int64(record.versionOffset/versionRecordSize) * metaRecordSize
+	if err := s.copyFile(dst, metaPrefix, 0, metaSize); err != nil {
+		return err
+	}
+	commits, err := dst.Open(commitPrefix, 0)
+	if err != nil {
+		return err
+	}
+	defer commits.Close()
+	// copied files are fsynced, checkpoint is durable even if the commit is not
+	record.relaxed = false
+	buf := make([]byte, commitRecordSize)
+	record.MarshalTo(buf)
+	if _, err := commits.Write(buf); err != nil {
+		return err
+	}
+	if err := commits.Commit(); err != nil {
+		return err
+	}
+	if pruned := s.pruned.Load(); pruned > 0 {
+		w, err := openWatermark(dst, prunePrefix)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if err := w.Store(pruned); err != nil {
+			return err
+		}
+	}
+	return dst.Commit()
+}
+
+// lastCommit returns the latest commit record that is intact.
+// Record may be partially written if store is committing concurrently.
+func (s *FileStore) lastCommit() (commitRecord, bool, error) {
+	var (
+		record commitRecord
+		buf    = make([]byte, commitRecordSize)
+	)
+	size, err := s.commits.Size()
+	if err != nil {
+		return record, false, err
+	}
+	for off := size - size%commitRecordSize; off > 0; off -= commitRecordSize {
+		if _, err := s.commits.ReadAt(buf, off-commitRecordSize); err != nil {
+			return record, false, err
+		}
+		if record.Unmarshal(buf) {
+			return record, true, nil
+		}
+	}
+	return record, false, nil
+}
+
+// linkFile creates a hard link to the file in the dst directory. If store is not on disk, or link is not
+// possible, file is copied.
+func (s *FileStore) linkFile(dst *Dir, prefix string, index uint32) error {
+	if _, ok := s.fs.(*afero.OsFs); ok {
+		if err := os.Link(s.dir.filePath(prefix, index), dst.filePath(prefix, index)); err == nil {
+			dst.dirty = true
+			return nil
+		}
+	}
+	return s.copyFile(dst, prefix, index, -1)
+}
+
+// copyFile copies size bytes of the file into the dst directory and fsyncs the copy. Whole file is copied
+// if size is negative.
+func (s *FileStore) copyFile(dst *Dir, prefix string, index uint32, size int64) error {
+	src, err := s.fs.Open(s.dir.filePath(prefix, index))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := dst.Open(prefix, index)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = src
+	if size >= 0 {
+		r = io.NewSectionReader(src, 0, size)
+	}
+	n, err := io.Copy(f.fd, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("file %s is shorter than committed size %d", s.dir.filePath(prefix, index), size)
+	}
+	f.dirty = true
+	return f.Commit()
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+func newChunkedReader(f *file, chunkSize, chunks int) *chunkedReader {
+	return &chunkedReader{
+		file:      f,
+		chunkSize: chunkSize,
+		maxChunks: chunks,
+		lru:       list.New(),
+		chunks:    map[int64]*list.Element{},
+	}
+}
+
+type chunk struct {
+	index int64
+	buf   []byte
+}
+
+// chunkedReader reads file in aligned chunks and keeps a limited number of recently used chunks in memory.
+// Files are append-only, therefore only complete chunks are kept, partial chunk at the end of the file
+// is read again on every access.
+type chunkedReader struct {
+	file      *file
+	chunkSize int
+	maxChunks int
+
+	mu     sync.Mutex
+	lru    *list.List
+	chunks map[int64]*list.Element
+
+	hits, misses uint64
+}
+
+func (r *chunkedReader) ReadAt(buf []byte, off int64) (int, error) {
+	if len(buf) >= r.chunkSize {
+		return r.file.ReadAt(buf, off)
+	}
+	size := int64(r.chunkSize)
+	n := 0
+	for n < len(buf) {
+		cur := off + int64(n)
+		index := cur / size
+		data, err := r.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		start := int(cur - index*size)
+		if start >= len(data) {
+			return n, io.EOF
+		}
+		n += copy(buf[n:], data[start:])
+		if len(data) < r.chunkSize && n < len(buf) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (r *chunkedReader) chunk(index int64) ([]byte, error) {
+	r.mu.Lock()
+	elem, exist := r.chunks[index]
+	if exist {
+		r.lru.MoveToFront(elem)
+		r.mu.Unlock()
+		atomic.AddUint64(&r.hits, 1)
+		return elem.Value.(*chunk).buf, nil
+	}
+	r.mu.Unlock()
+	atomic.AddUint64(&r.misses, 1)
+
+	buf := make([]byte, r.chunkSize)
+	n, err := r.file.ReadAt(buf, index*int64(r.chunkSize))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < r.chunkSize {
+		return buf[:n], nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exist := r.chunks[index]; !exist {
+		if r.lru.Len() >= r.maxChunks {
+			evicted := r.lru.Remove(r.lru.Back()).(*chunk)
+			delete(r.chunks, evicted.index)
+		}
+		r.chunks[index] = r.lru.PushFront(&chunk{index: index, buf: buf})
+	}
+	return buf, nil
+}
+
+func (r *chunkedReader) ReadStats(stats *GroupStats) {
+	stats.BufferHit += atomic.LoadUint64(&r.hits)
+	stats.BufferMiss += atomic.LoadUint64(&r.misses)
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// ValueEncrypter is implemented by backends that encrypt values.
+type ValueEncrypter interface {
+	ValueCipher() cipher.AEAD
+}
+
+// ValueCipher returns cipher used by the backend, or nil if values are not encrypted.
+func ValueCipher(b Backend) cipher.AEAD {
+	if e, ok := b.(ValueEncrypter); ok {
+		return e.ValueCipher()
+	}
+	return nil
+}
+
+// newValueCipher creates AES-GCM cipher, key must be 16, 24 or 32 bytes long.
+func newValueCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// ValueCipher returns cipher created from the encryption key in the config.
+func (s *FileStore) ValueCipher() cipher.AEAD {
+	return s.aead
+}
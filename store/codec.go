@@ -0,0 +1,107 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec encodes values before they are written to the value group.
+type Codec interface {
+	// ID is persisted with every encoded value and used to find a codec for decoding.
+	// Must be in range [1, 127], zero is reserved for values that are stored without encoding.
+	ID() byte
+	Encode(dst, src []byte) []byte
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// ValueEncoder is implemented by backends that encode values with a codec.
+type ValueEncoder interface {
+	ValueCodec() Codec
+}
+
+// ValueCodec returns codec used by the backend, or nil if values are not encoded.
+func ValueCodec(b Backend) Codec {
+	if e, ok := b.(ValueEncoder); ok {
+		return e.ValueCodec()
+	}
+	return nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{}
+)
+
+// RegisterCodec makes codec available for decoding values written by it.
+// Codec with the same id must not be registered twice.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c.ID() == 0 || c.ID() >= 0x80 {
+		panic(fmt.Sprintf("codec id %d is reserved", c.ID()))
+	}
+	if _, exist := codecs[c.ID()]; exist {
+		panic(fmt.Sprintf("codec %d already registered", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+// GetCodec returns registered codec by id.
+func GetCodec(id byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, exist := codecs[id]
+	return c, exist
+}
+
+const flateCodecID = 1
+
+// Flate is a codec that compresses values with compress/flate.
+var Flate Codec = flateCodec{}
+
+func init() {
+	RegisterCodec(Flate)
+}
+
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() interface{} {
+		return flate.NewReader(nil)
+	}}
+)
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte {
+	return flateCodecID
+}
+
+func (flateCodec) Encode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(buf)
+	// writes to bytes.Buffer never fail
+	_, _ = w.Write(src)
+	_ = w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+func (flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ValueRef points to the body of the value in the value group.
+type ValueRef struct {
+	Index, Offset uint32
+	// Size of the body without crc.
+	Size uint32
+	// Encoded is true if the body starts with a header.
+	Encoded bool
+}
+
+// ValueIndex maps hash of the value to the body that was written before.
+type ValueIndex interface {
+	Lookup(hash [32]byte) (ValueRef, bool)
+	Add(hash [32]byte, ref ValueRef)
+}
+
+// ValueDeduplicator is implemented by backends that reuse bodies of identical values.
+type ValueDeduplicator interface {
+	// ValueIndex returns nil if deduplication is disabled.
+	ValueIndex() ValueIndex
+}
+
+// DedupIndex returns index of the backend, or nil if deduplication is not supported or disabled.
+func DedupIndex(b Backend) ValueIndex {
+	if d, ok := b.(ValueDeduplicator); ok {
+		return d.ValueIndex()
+	}
+	return nil
+}
+
+// ValueIndex returns index of the current generation.
+func (s *FileStore) ValueIndex() ValueIndex {
+	if s.dedup == nil {
+		return nil
+	}
+	return s.dedup
+}
+
+func newDedupIndex(size int) *dedupIndex {
+	return &dedupIndex{
+		size:    size,
+		lru:     list.New(),
+		entries: map[[32]byte]*list.Element{},
+	}
+}
+
+type dedupEntry struct {
+	hash [32]byte
+	ref  ValueRef
+}
+
+// dedupIndex keeps references to the most recently used values. It is safe to use from multiple goroutines.
+// Index is not persisted.
+type dedupIndex struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[[32]byte]*list.Element
+}
+
+func (d *dedupIndex) Lookup(hash [32]byte) (ValueRef, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, exist := d.entries[hash]
+	if !exist {
+		return ValueRef{}, false
+	}
+	d.lru.MoveToFront(elem)
+	return elem.Value.(*dedupEntry).ref, true
+}
+
+func (d *dedupIndex) Add(hash [32]byte, ref ValueRef) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elem, exist := d.entries[hash]; exist {
+		d.lru.MoveToFront(elem)
+		return
+	}
+	if d.lru.Len() >= d.size {
+		entry := d.lru.Remove(d.lru.Back()).(*dedupEntry)
+		delete(d.entries, entry.hash)
+	}
+	d.entries[hash] = d.lru.PushFront(&dedupEntry{hash: hash, ref: ref})
+}
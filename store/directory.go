@@ -2,12 +2,15 @@ package store
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 
 	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
 )
 
 func OpenDir(fs afero.Fs, path string) (*Dir, error) {
@@ -26,13 +29,35 @@ func OpenDir(fs afero.Fs, path string) (*Dir, error) {
 	}, nil
 }
 
+// openReadOnlyDir opens existing directory, files are opened read-only and missing files are read as empty.
+func openReadOnlyDir(fs afero.Fs, path string) (*Dir, error) {
+	fd, err := fs.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Dir{
+		fs:       fs,
+		fd:       fd,
+		readOnly: true,
+	}, nil
+}
+
 type Dir struct {
-	fs    afero.Fs
-	fd    afero.File
+	fs afero.Fs
+	fd afero.File
+	// datasync is inherited by opened files
+	datasync bool
+	// readOnly directory is never modified, see openReadOnlyDir
+	readOnly bool
+
+	// files of different groups are opened concurrently
+	mu    sync.Mutex
 	dirty bool
 }
 
 func (d *Dir) Commit() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.dirty {
 		err := d.fd.Sync()
 		if err != nil {
@@ -43,41 +68,152 @@ func (d *Dir) Commit() error {
 	return nil
 }
 
+// Path returns path to the directory.
+func (d *Dir) Path() string {
+	return d.fd.Name()
+}
+
+func (d *Dir) filePath(prefix string, index uint32) string {
+	return filepath.Join(d.fd.Name(), fmt.Sprintf("%s-%d.%s", prefix, index, dbformat))
+}
+
 func (d *Dir) Open(prefix string, index uint32) (*file, error) {
-	d.dirty = true
-	path := filepath.Join(d.fd.Name(), fmt.Sprintf("%s-%d.%s", prefix, index, dbformat))
+	path := d.filePath(prefix, index)
+	if d.readOnly {
+		fd, err := d.fs.OpenFile(path, os.O_RDONLY, 0)
+		if os.IsNotExist(err) {
+			return &file{fd: mem.NewReadOnlyFileHandle(mem.CreateFile(path))}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &file{fd: fd}, nil
+	}
+	d.markDirty()
 	fd, err := d.fs.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil && !os.IsExist(err) {
 		return nil, err
 	}
-	return &file{fd: fd}, nil
+	return &file{fd: fd, datasync: d.datasync}, nil
 }
 
-func (d *Dir) LastIndex(prefix string) (uint32, error) {
-	names, err := d.fd.Readdirnames(-1)
+// openRandom opens the file for writes at arbitrary offsets, see file.WriteAt.
+func (d *Dir) openRandom(prefix string, index uint32) (*file, error) {
+	d.markDirty()
+	fd, err := d.fs.OpenFile(d.filePath(prefix, index), os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return &file{fd: fd, datasync: d.datasync}, nil
+}
+
+// names returns names of all entries in the directory.
+func (d *Dir) names() ([]string, error) {
+	// opened descriptor remembers position, Readdirnames on it will return only new entries
+	fd, err := d.fs.Open(d.fd.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Readdirnames(-1)
+}
+
+// Indexes returns indexes of all files with the prefix.
+func (d *Dir) Indexes(prefix string) ([]uint32, error) {
+	names, err := d.names()
+	if err != nil {
+		return nil, err
 	}
 	var (
-		max  uint32
-		expr = regexp.MustCompile(fmt.Sprintf("(?:%s-)([0-9]+)", prefix))
+		rst  []uint32
+		expr = regexp.MustCompile(fmt.Sprintf("^%s-([0-9]+)\\.%s$", prefix, dbformat))
 	)
 	for _, name := range names {
 		matches := expr.FindStringSubmatch(name)
 		if len(matches) > 1 {
 			idx64, err := strconv.ParseUint(matches[1], 10, 32)
 			if err != nil {
-				return 0, fmt.Errorf("inccorect file forat: %w", err)
-			}
-			idx := uint32(idx64)
-			if idx > max {
-				max = idx
+				return nil, fmt.Errorf("inccorect file forat: %w", err)
 			}
+			rst = append(rst, uint32(idx64))
+		}
+	}
+	return rst, nil
+}
+
+func (d *Dir) LastIndex(prefix string) (uint32, error) {
+	indexes, err := d.Indexes(prefix)
+	if err != nil {
+		return 0, err
+	}
+	var max uint32
+	for _, idx := range indexes {
+		if idx > max {
+			max = idx
 		}
 	}
 	return max, nil
 }
 
+// RemoveFile removes a single file.
+func (d *Dir) RemoveFile(prefix string, index uint32) error {
+	d.markDirty()
+	return d.fs.Remove(d.filePath(prefix, index))
+}
+
+// replaceFile replaces the file with a copy of its first size bytes. Unlike truncate it doesn't modify
+// the file, which may be hard linked by a checkpoint. Copy is fsynced before it is renamed into place.
+func (d *Dir) replaceFile(prefix string, index uint32, size int64) error {
+	path := d.filePath(prefix, index)
+	src, err := d.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".tmp"
+	dst, err := d.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.NewSectionReader(src, 0, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("file %s is shorter than %d", path, size)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err = firstError(err, dst.Close()); err != nil {
+		_ = d.fs.Remove(tmp)
+		return err
+	}
+	d.markDirty()
+	return d.fs.Rename(tmp, path)
+}
+
+// Remove removes all files with the prefix.
+func (d *Dir) Remove(prefix string) error {
+	indexes, err := d.Indexes(prefix)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := d.fs.Remove(d.filePath(prefix, idx)); err != nil {
+			return err
+		}
+	}
+	if len(indexes) > 0 {
+		d.markDirty()
+	}
+	return nil
+}
+
+// markDirty marks directory for fsync on the next commit.
+func (d *Dir) markDirty() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dirty = true
+}
+
 func (d *Dir) Close() error {
 	return d.fd.Close()
 }
@@ -0,0 +1,107 @@
+package store
+
+import "time"
+
+// Durability defines when committed data is fsynced.
+type Durability uint8
+
+const (
+	// DurabilityFsync fsyncs the directory and every written file on each commit.
+	DurabilityFsync Durability = iota
+	// DurabilityFdatasync is the same as DurabilityFsync but files are synced with fdatasync,
+	// metadata that is not needed to read the data, e.g. modification time, is not flushed.
+	// Same as DurabilityFsync on platforms without fdatasync.
+	DurabilityFdatasync
+	// DurabilityGroup fsyncs every SyncCommits commits or if SyncInterval elapsed since the last fsync.
+	// Interval is checked only on commit.
+	DurabilityGroup
+	// DurabilityNone never fsyncs on commit, written data reaches the disk when the operating system decides.
+	// Useful for tests and replays that can be restarted from scratch. Open reads all data written since
+	// the last durable commit to check it, with this level it is all data unless the store was synced.
+	DurabilityNone
+)
+
+// relaxedCommit is set in the version offset of the commit record that was written without fsync.
+// Version file is limited to 4GiB, the bit is never used by the offset.
+const relaxedCommit = 1 << 63
+
+// syncDue counts relaxed commits and returns true if the next commit must be durable.
+func (s *FileStore) syncDue() bool {
+	switch s.conf.Durability {
+	case DurabilityNone:
+		return false
+	case DurabilityGroup:
+		if s.conf.SyncCommits == 0 && s.conf.SyncInterval == 0 {
+			return true
+		}
+		if s.conf.SyncCommits > 0 && s.relaxed+1 >= s.conf.SyncCommits {
+			return true
+		}
+		return s.conf.SyncInterval > 0 && time.Since(s.lastSync) >= s.conf.SyncInterval
+	}
+	return true
+}
+
+// commitRelaxed writes buffered data, pending version records and the commit record without fsync.
+// Such commit is recovered on open if all of its data reached the disk, which is checked with the checksums
+// in the commit records, otherwise the store is recovered to one of the earlier commits, at least to the
+// last durable one.
+func (s *FileStore) commitRelaxed() error {
+	if err := s.trees.Flush(); err != nil {
+		return err
+	}
+	if err := s.values.Flush(); err != nil {
+		return err
+	}
+	if err := s.writeVersions(); err != nil {
+		return err
+	}
+	if err := s.writeCommit(false); err != nil {
+		return err
+	}
+	s.relaxed++
+	return nil
+}
+
+// Sync makes all written data and version records durable regardless of the durability level.
+// Directory and groups are synced concurrently.
+func (s *FileStore) Sync() error {
+	if s.conf.ReadOnly {
+		return ErrReadOnly
+	}
+	// meta records are durable before version records
+	if err := s.writeMeta(); err != nil {
+		return err
+	}
+	if err := s.syncGroups(); err != nil {
+		return err
+	}
+	if err := s.writeVersions(); err != nil {
+		return err
+	}
+	f, err := s.getVersionFile()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	s.metrics.versionFsync.Since(start)
+	if err := s.roots.sync(); err != nil {
+		return err
+	}
+	if err := s.writeCommit(true); err != nil {
+		return err
+	}
+	s.relaxed = 0
+	s.lastSync = time.Now()
+	s.metrics.durableVersion.Set(s.versionOffset.Size() / versionRecordSize)
+	return nil
+}
+
+// DurableVersion returns the latest version that is known to be durable. Versions committed after it
+// may be lost on crash. Can be called concurrently with other methods.
+func (s *FileStore) DurableVersion() uint64 {
+	return s.metrics.durableVersion.Load()
+}
@@ -1,26 +1,45 @@
 package store
 
 import (
+	"io"
+
 	"github.com/spf13/afero"
 )
 
 type file struct {
 	fd    afero.File
 	dirty bool
+	// datasync enables fdatasync instead of fsync on commit
+	datasync bool
 }
 
 func (f *file) Write(buf []byte) (int, error) {
 	f.dirty = true
+	// afero.MemMapFs shares offset between ReadAt and Write and respects O_APPEND only on open
+	if _, err := f.fd.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
 	return f.fd.Write(buf)
 }
 
+// WriteAt writes buf at the offset, file must be opened without O_APPEND.
+func (f *file) WriteAt(buf []byte, off int64) (int, error) {
+	f.dirty = true
+	return f.fd.WriteAt(buf, off)
+}
+
 func (f *file) ReadAt(buf []byte, off int64) (int, error) {
 	return f.fd.ReadAt(buf, off)
 }
 
 func (f *file) Commit() error {
 	if f.dirty {
-		err := f.fd.Sync()
+		var err error
+		if f.datasync {
+			err = fdatasync(f.fd)
+		} else {
+			err = f.fd.Sync()
+		}
 		if err != nil {
 			return err
 		}
@@ -29,6 +48,14 @@ func (f *file) Commit() error {
 	return nil
 }
 
+// Truncate changes size of the file and fsyncs it.
+func (f *file) Truncate(size int64) error {
+	if err := f.fd.Truncate(size); err != nil {
+		return err
+	}
+	return f.fd.Sync()
+}
+
 func (f *file) Close() error {
 	return f.fd.Close()
 }
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const generationDirPrefix = "gen"
+
+var generationDirExpr = regexp.MustCompile(fmt.Sprintf("^%s-([0-9]+)$", generationDirPrefix))
+
+// generationPath returns directory with tree, value and version files of the generation.
+// Files of the zero generation are stored in the root directory.
+func (s *FileStore) generationPath(gen uint64) string {
+	if gen == 0 {
+		return s.root.Path()
+	}
+	return filepath.Join(s.root.Path(), fmt.Sprintf("%s-%d", generationDirPrefix, gen))
+}
+
+// Generation returns identifier of the current files generation.
+func (s *FileStore) Generation() uint64 {
+	return s.gen
+}
+
+// NewGeneration creates an empty store in the directory for the next generation.
+// Written data is not visible to the current store until SwitchGeneration.
+// Leftovers from an interrupted compaction are removed.
+func (s *FileStore) NewGeneration() (*FileStore, error) {
+	gen := s.gen + 1
+	if err := s.fs.RemoveAll(s.generationPath(gen)); err != nil {
+		return nil, err
+	}
+	// values are encrypted with the same key, node cache is not shared because positions are different
+	next := &FileStore{
+		fs:         s.fs,
+		conf:       s.conf,
+		root:       s.root,
+		generation: s.generation,
+		pruned:     s.pruned,
+		metrics:    s.metrics,
+		pinned:     newPinned(),
+		aead:       s.aead,
+	}
+	if err := next.openGeneration(gen); err != nil {
+		if next.dir != nil {
+			next.closeGeneration()
+		}
+		return nil, err
+	}
+	if _, err := next.getVersionFile(); err != nil {
+		next.closeGeneration()
+		return nil, err
+	}
+	s.root.dirty = true
+	return next, nil
+}
+
+// SwitchGeneration makes next store durable, persists its generation and replaces current files with
+// files from next store. Files of the previous generation are removed.
+// Next store must not be used after the switch.
+// Caller is responsible to ensure that there are no concurrent readers or writers.
+func (s *FileStore) SwitchGeneration(next *FileStore) error {
+	if next.gen != s.gen+1 {
+		return fmt.Errorf("generation %d can't replace generation %d", next.gen, s.gen)
+	}
+	if err := next.Sync(); err != nil {
+		return err
+	}
+	if err := s.generation.Store(next.gen); err != nil {
+		return err
+	}
+	if err := s.root.Commit(); err != nil {
+		return err
+	}
+	prev := *s
+	s.gen, s.dir = next.gen, next.dir
+	s.trees, s.values = next.trees, next.values
+	s.versions, s.versionOffset = next.versions, next.versionOffset
+	s.commits = next.commits
+	s.meta = next.meta
+	s.roots = next.roots
+	s.relaxed, s.lastSync = 0, next.lastSync
+	s.treeSum, s.valueSum = next.treeSum, next.valueSum
+	s.dedup = next.dedup
+	if s.cache != nil {
+		s.cache.Purge()
+	}
+	if err := prev.closeGeneration(); err != nil {
+		return err
+	}
+	return s.removeGeneration(prev.gen)
+}
+
+// DiscardGeneration closes next store and removes its files.
+func (s *FileStore) DiscardGeneration(next *FileStore) error {
+	if err := next.closeGeneration(); err != nil {
+		return err
+	}
+	return s.removeGeneration(next.gen)
+}
+
+func (s *FileStore) removeGeneration(gen uint64) error {
+	if gen != 0 {
+		return s.fs.RemoveAll(s.generationPath(gen))
+	}
+	for _, prefix := range []string{treePrefix, valuePrefix, versionPrefix, commitPrefix, metaPrefix, rootsPrefix} {
+		if err := s.root.Remove(prefix); err != nil {
+			return err
+		}
+	}
+	return s.root.Commit()
+}
+
+// removeStaleGenerations removes files of every generation except the current.
+// They are left if compaction was interrupted before or right after the switch.
+func (s *FileStore) removeStaleGenerations() error {
+	names, err := s.root.names()
+	if err != nil {
+		return err
+	}
+	current := s.generation.Load()
+	for _, name := range names {
+		matches := generationDirExpr.FindStringSubmatch(name)
+		if len(matches) < 2 {
+			continue
+		}
+		gen, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if gen != current {
+			if err := s.removeGeneration(gen); err != nil {
+				return err
+			}
+		}
+	}
+	if current != 0 {
+		return s.removeGeneration(0)
+	}
+	return nil
+}
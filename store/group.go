@@ -1,17 +1,26 @@
 package store
 
-import "sync"
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+)
 
-func newGroup(prefix string, dir *Dir, fileSize uint32, bufSize int) *filesGroup {
+func newGroup(prefix string, dir *Dir, fileSize uint32, bufSize int, readChunkSize, readChunks int, mmap bool) *filesGroup {
 	return &filesGroup{
-		maxFileSize: fileSize,
-		groupPrefix: prefix,
-		dir:         dir,
-		bufSize:     bufSize,
-		dirtyOffset: &Offset{maxFileSize: fileSize},
-		offset:      &Offset{maxFileSize: fileSize},
-		readers:     map[uint32]reader{},
-		opened:      map[uint32]*file{},
+		maxFileSize:   fileSize,
+		groupPrefix:   prefix,
+		dir:           dir,
+		bufSize:       bufSize,
+		readChunkSize: readChunkSize,
+		readChunks:    readChunks,
+		mmap:          mmap,
+		dirtyOffset:   &Offset{maxFileSize: fileSize},
+		offset:        &Offset{maxFileSize: fileSize},
+		readers:       map[uint32]reader{},
+		opened:        map[uint32]*file{},
 	}
 }
 
@@ -20,6 +29,11 @@ type reader interface {
 	ReadStats(*GroupStats)
 }
 
+// viewer is implemented by readers that can return bytes without copying.
+type viewer interface {
+	View(int64, int) ([]byte, error)
+}
+
 type writer interface {
 	Write([]byte) (int, error)
 	Commit() error
@@ -43,6 +57,13 @@ type filesGroup struct {
 	dirtyOffset *Offset
 	offset      *Offset
 
+	// reads are buffered in chunks if readChunkSize is not zero
+	readChunkSize, readChunks int
+	// sealed files are memory mapped if mmap is true
+	mmap bool
+	// files with index lower than sealed are complete and flushed
+	sealed uint32
+
 	omu    sync.Mutex
 	opened map[uint32]*file
 
@@ -66,6 +87,7 @@ func (fg *filesGroup) restore() error {
 	fg.offset = newOffset(last, uint32(size), fg.maxFileSize)
 	fg.dirtyOffset = newOffset(last, uint32(size), fg.maxFileSize)
 	fg.opened[last] = f
+	atomic.StoreUint32(&fg.sealed, last)
 	return nil
 }
 
@@ -84,19 +106,57 @@ func (fg *filesGroup) get(index uint32) (*file, error) {
 	return f, nil
 }
 
+// reader returns the reader for the file with index. Mapped reader is acquired and must be released
+// with releaseReader after it is used.
 func (fg *filesGroup) reader(index uint32) (reader, error) {
 	fg.rmu.Lock()
 	defer fg.rmu.Unlock()
 	r, exist := fg.readers[index]
 	if exist {
-		return r, nil
+		if m, isMapped := r.(*mapped); isMapped {
+			m.acquire()
+			return m, nil
+		}
+		if !fg.isSealed(index) {
+			return r, nil
+		}
 	}
 	f, err := fg.get(index)
 	if err != nil {
 		return nil, err
 	}
-	fg.readers[index] = f
-	return f, nil
+	if fg.isSealed(index) {
+		m, err := mmapFile(f)
+		if err == nil {
+			fg.readers[index] = m
+			m.acquire()
+			return m, nil
+		}
+		if err != errMmapUnsupported {
+			return nil, err
+		}
+	}
+	if exist {
+		return r, nil
+	}
+	r = f
+	if fg.readChunkSize > 0 && fg.readChunks > 0 {
+		r = newChunkedReader(f, fg.readChunkSize, fg.readChunks)
+	}
+	fg.readers[index] = r
+	return r, nil
+}
+
+// releaseReader releases the reader that was returned by reader.
+func releaseReader(r reader) error {
+	if m, ok := r.(*mapped); ok {
+		return m.release()
+	}
+	return nil
+}
+
+func (fg *filesGroup) isSealed(index uint32) bool {
+	return fg.mmap && index < atomic.LoadUint32(&fg.sealed)
 }
 
 func (fg *filesGroup) getWriter(index uint32) (writer, error) {
@@ -107,13 +167,11 @@ func (fg *filesGroup) getWriter(index uint32) (writer, error) {
 	if err != nil {
 		return nil, err
 	}
-	if fg.writer == nil {
-		fg.writer = newBuffered(f, fg.bufSize)
-	} else {
+	if fg.writer != nil {
 		fg.dirty = append(fg.dirty, fg.writer)
-		fg.writer = newBuffered(f, fg.bufSize)
-		fg.windex = index
 	}
+	fg.writer = newBuffered(f, fg.bufSize)
+	fg.windex = index
 	return fg.writer, nil
 }
 
@@ -130,12 +188,48 @@ func (fg *filesGroup) Write(buf []byte) (int, error) {
 	return w.Write(buf)
 }
 
-func (fg *filesGroup) ReadAt(buf []byte, index, off uint32) (int, error) {
-	f, err := fg.reader(index)
+func (fg *filesGroup) ReadAt(buf []byte, index, off uint32) (n int, err error) {
+	r, err := fg.reader(index)
 	if err != nil {
 		return 0, err
 	}
-	return f.ReadAt(buf, int64(off))
+	defer func() {
+		if rerr := releaseReader(r); err == nil {
+			err = rerr
+		}
+	}()
+	return r.ReadAt(buf, int64(off))
+}
+
+// View calls f with size bytes from the file at the offset. If file is memory mapped the slice
+// points to the mapped memory, it must not be modified or retained after f returns.
+// Mapping is not unmapped while f is running.
+func (fg *filesGroup) View(index, off uint32, size int, f func([]byte) error) (err error) {
+	r, err := fg.reader(index)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := releaseReader(r); err == nil {
+			err = rerr
+		}
+	}()
+	if v, ok := r.(viewer); ok {
+		buf, err := v.View(int64(off), size)
+		if err != nil {
+			return err
+		}
+		return f(buf)
+	}
+	buf := make([]byte, size)
+	n, err := r.ReadAt(buf, int64(off))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return f(buf)
 }
 
 func (fg *filesGroup) Flush() error {
@@ -149,6 +243,7 @@ func (fg *filesGroup) Flush() error {
 			return err
 		}
 	}
+	fg.seal()
 	return nil
 }
 
@@ -165,19 +260,190 @@ func (fg *filesGroup) Commit() error {
 		w.Reset()
 	}
 	fg.dirty = nil
+	fg.seal()
 	return nil
 }
 
-func (fg *filesGroup) Close() error {
-	for _, f := range fg.opened {
+// truncate removes all data after the offset in the file with index.
+// Returns number of removed bytes.
+func (fg *filesGroup) truncate(index, offset uint32) (uint64, error) {
+	last, end := fg.offset.Offset()
+	if index > last || (index == last && offset >= end) {
+		return 0, nil
+	}
+	if err := fg.resetReaders(); err != nil {
+		return 0, err
+	}
+	// writers must be committed, data that they point to is removed
+	fg.writer, fg.dirty = nil, nil
+	indexes, err := fg.dir.Indexes(fg.groupPrefix)
+	if err != nil {
+		return 0, err
+	}
+	var discarded uint64
+	for _, i := range indexes {
+		if i <= index {
+			continue
+		}
+		f, err := fg.get(i)
+		if err != nil {
+			return 0, err
+		}
+		size, err := f.Size()
+		if err != nil {
+			return 0, err
+		}
 		if err := f.Close(); err != nil {
-			return err
+			return 0, err
+		}
+		delete(fg.opened, i)
+		if err := fg.dir.RemoveFile(fg.groupPrefix, i); err != nil {
+			return 0, err
 		}
+		discarded += uint64(size)
+	}
+	f, err := fg.get(index)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	if index < last {
+		// sealed file may be hard linked by a checkpoint, it is replaced with a truncated copy
+		if err := f.Close(); err != nil {
+			return 0, err
+		}
+		delete(fg.opened, index)
+		if err := fg.dir.replaceFile(fg.groupPrefix, index, int64(offset)); err != nil {
+			return 0, err
+		}
+	} else if err := f.Truncate(int64(offset)); err != nil {
+		return 0, err
+	}
+	discarded += uint64(size) - uint64(offset)
+	fg.offset = newOffset(index, offset, fg.maxFileSize)
+	fg.dirtyOffset = newOffset(index, offset, fg.maxFileSize)
+	atomic.StoreUint32(&fg.sealed, index)
+	return discarded, nil
+}
+
+// checksum returns crc of the bytes between two offsets. False is returned if the group doesn't have all of them.
+func (fg *filesGroup) checksum(fromIndex, fromOffset, toIndex, toOffset uint32) (uint32, bool, error) {
+	var (
+		sum uint32
+		buf = make([]byte, 64<<10)
+	)
+	for i := fromIndex; i <= toIndex; i++ {
+		f, err := fg.get(i)
+		if err != nil {
+			return 0, false, err
+		}
+		start, end := int64(0), int64(toOffset)
+		if i == fromIndex {
+			start = int64(fromOffset)
+		}
+		if i < toIndex {
+			// record that doesn't fit into the file is written to the next one
+			if end, err = f.Size(); err != nil {
+				return 0, false, err
+			}
+		}
+		for start < end {
+			chunk := buf
+			if rest := end - start; rest < int64(len(chunk)) {
+				chunk = chunk[:rest]
+			}
+			n, err := f.ReadAt(chunk, start)
+			sum = crc32.Update(sum, crcTable, chunk[:n])
+			if errors.Is(err, io.EOF) {
+				return 0, false, nil
+			}
+			if err != nil {
+				return 0, false, err
+			}
+			start += int64(n)
+		}
+	}
+	return sum, true, nil
+}
+
+// tail returns the number of bytes after the offset and moves the end of the group to the offset
+// without modifying files. It is used instead of truncate by the read-only store.
+func (fg *filesGroup) tail(index, offset uint32) (uint64, error) {
+	last, end := fg.offset.Offset()
+	if index > last || (index == last && offset >= end) {
+		return 0, nil
+	}
+	indexes, err := fg.dir.Indexes(fg.groupPrefix)
+	if err != nil {
+		return 0, err
+	}
+	var discarded uint64
+	for _, i := range indexes {
+		if i < index {
+			continue
+		}
+		f, err := fg.get(i)
+		if err != nil {
+			return 0, err
+		}
+		size, err := f.Size()
+		if err != nil {
+			return 0, err
+		}
+		if i == index {
+			size -= int64(offset)
+		}
+		discarded += uint64(size)
+	}
+	fg.offset = newOffset(index, offset, fg.maxFileSize)
+	fg.dirtyOffset = newOffset(index, offset, fg.maxFileSize)
+	return discarded, nil
+}
+
+// resetReaders removes readers that may keep data that is no longer in the files.
+// Mappings are unmapped after reads that are in progress are finished.
+func (fg *filesGroup) resetReaders() error {
+	fg.rmu.Lock()
+	defer fg.rmu.Unlock()
+	for index, r := range fg.readers {
+		if m, ok := r.(*mapped); ok {
+			if err := m.Close(); err != nil {
+				return err
+			}
+		}
+		delete(fg.readers, index)
+	}
+	return nil
+}
+
+// seal marks all files before the one that is currently written as sealed.
+// Must be called after dirty writers were flushed.
+func (fg *filesGroup) seal() {
+	if fg.writer != nil && fg.windex > atomic.LoadUint32(&fg.sealed) {
+		atomic.StoreUint32(&fg.sealed, fg.windex)
+	}
+}
+
+// Close closes every mapping and file of the group, the first error is returned.
+func (fg *filesGroup) Close() error {
+	var errs []error
+	fg.rmu.Lock()
+	defer fg.rmu.Unlock()
+	for _, r := range fg.readers {
+		if m, ok := r.(*mapped); ok {
+			errs = append(errs, m.Close())
+		}
+	}
+	for _, f := range fg.opened {
+		errs = append(errs, f.Close())
 	}
 	fg.writer = nil
 	fg.dirty = nil
 	fg.readers = nil
-	return nil
+	return firstError(errs...)
 }
 
 func (fg *filesGroup) ReadStats(stats *GroupStats) {
@@ -187,10 +453,16 @@ func (fg *filesGroup) ReadStats(stats *GroupStats) {
 	for _, w := range fg.dirty {
 		w.ReadStats(stats)
 	}
+	fg.rmu.Lock()
 	for _, r := range fg.readers {
 		r.ReadStats(stats)
 	}
-	stats.MeanFlushSize = stats.FlushSize / stats.FlushCount
-	stats.FlushUtilization = float64(stats.MeanFlushSize) / float64(fg.bufSize)
+	fg.rmu.Unlock()
+	if stats.FlushCount > 0 {
+		stats.MeanFlushSize = stats.FlushSize / stats.FlushCount
+	}
+	if fg.bufSize > 0 {
+		stats.FlushUtilization = float64(stats.MeanFlushSize) / float64(fg.bufSize)
+	}
 	stats.DiskSize = uint64(fg.offset.Size())
 }
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockName = "LOCK"
+
+// ErrLocked returned by Open if store directory is used by another store.
+var ErrLocked = errors.New("store locked")
+
+// dirLock is an exclusive advisory lock on the LOCK file in the store directory.
+type dirLock struct {
+	fd *os.File
+}
+
+func lockDir(path string) (*dirLock, error) {
+	fd, err := os.OpenFile(filepath.Join(path, lockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(fd); err != nil {
+		fd.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+		}
+		return nil, err
+	}
+	return &dirLock{fd: fd}, nil
+}
+
+func (l *dirLock) Release() error {
+	if err := funlock(l.fd); err != nil {
+		l.fd.Close()
+		return err
+	}
+	return l.fd.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package store
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("would block")
+
+// flock is not supported, store relies on the caller to prevent concurrent writers.
+func flock(fd *os.File) error {
+	return nil
+}
+
+func funlock(fd *os.File) error {
+	return nil
+}
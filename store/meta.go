@@ -0,0 +1,196 @@
+package store
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	metaPrefix = "meta"
+	// value index, value offset, size of the metadata, crc
+	metaRecordSize = 4 + 4 + 4 + 4
+	// metaEncrypted is set in the size of the record if metadata is encrypted
+	metaEncrypted = 1 << 31
+)
+
+// VersionMetaStore is implemented by backends that keep metadata of versions.
+type VersionMetaStore interface {
+	// WriteVersionMeta adds metadata to the version record that is written next.
+	WriteVersionMeta(meta []byte) error
+	// ReadVersionMeta returns metadata of the version, nil if the version was written without metadata.
+	ReadVersionMeta(version uint64) ([]byte, error)
+}
+
+// metaRecord points to the metadata of the version in the value group. Record is written to the meta file
+// for every version, record of the version without metadata is empty.
+type metaRecord struct {
+	index, offset, size uint32
+}
+
+func (m *metaRecord) MarshalTo(buf []byte) {
+	order.PutUint32(buf, m.index)
+	order.PutUint32(buf[4:], m.offset)
+	order.PutUint32(buf[8:], m.size)
+	putCrcSum32(buf[12:], buf[:12])
+}
+
+// additionalData authenticates position of the encrypted metadata.
+func (m *metaRecord) additionalData() []byte {
+	buf := make([]byte, 8)
+	order.PutUint32(buf, m.index)
+	order.PutUint32(buf[4:], m.offset)
+	return buf
+}
+
+func (m *metaRecord) Unmarshal(buf []byte) bool {
+	if crcSum32(buf[:12]) != order.Uint32(buf[12:]) {
+		return false
+	}
+	m.index = order.Uint32(buf)
+	m.offset = order.Uint32(buf[4:])
+	m.size = order.Uint32(buf[8:])
+	return true
+}
+
+// WriteVersionMeta writes metadata with crc to the value group. Metadata is not encoded, it is encrypted
+// if the store has an encryption key. Position of the metadata is used as additional data, so that
+// encrypted metadata can't be moved to another version.
+func (s *FileStore) WriteVersionMeta(meta []byte) error {
+	size := len(meta)
+	if s.aead != nil {
+		size += s.aead.NonceSize() + s.aead.Overhead()
+	}
+	if size+4 > int(s.conf.MaxFileSize) {
+		return fmt.Errorf("metadata is longer then max file size, %d > %d", size+4, s.conf.MaxFileSize)
+	}
+	index, offset := s.values.AllocateOffset(size + 4)
+	record := metaRecord{index: index, offset: offset, size: uint32(size)}
+	body := make([]byte, 0, size+4)
+	if s.aead != nil {
+		body = body[:s.aead.NonceSize()]
+		if _, err := rand.Read(body); err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		body = s.aead.Seal(body, body, meta, record.additionalData())
+		record.size |= metaEncrypted
+	} else {
+		body = append(body, meta...)
+	}
+	body = body[:size+4]
+	putCrcSum32(body[size:], body[:size])
+	n, err := s.WriteValue(body)
+	if err != nil {
+		return err
+	}
+	if n != len(body) {
+		return errors.New("incomplete metadata write")
+	}
+	s.nextMeta = record
+	return nil
+}
+
+// addMeta adds meta record for the version that is written, metadata from WriteVersionMeta is used only once.
+func (s *FileStore) addMeta() {
+	buf := make([]byte, metaRecordSize)
+	s.nextMeta.MarshalTo(buf)
+	s.pendingMeta = append(s.pendingMeta, buf...)
+	s.nextMeta = metaRecord{}
+}
+
+// writeMeta writes pending meta records to the meta file. Must be called before version records are written.
+func (s *FileStore) writeMeta() error {
+	if len(s.pendingMeta) == 0 {
+		return nil
+	}
+	n, err := s.meta.Write(s.pendingMeta)
+	if err != nil {
+		return err
+	}
+	if n != len(s.pendingMeta) {
+		return errors.New("incomplete meta write")
+	}
+	s.pendingMeta = s.pendingMeta[:0]
+	return nil
+}
+
+func (s *FileStore) ReadVersionMeta(version uint64) ([]byte, error) {
+	if version == 0 {
+		return nil, errors.New("version 0 not found")
+	}
+	if err := s.checkPruned(version); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, metaRecordSize)
+	// meta file may be written concurrently, records are written before the version records
+	if _, err := s.meta.ReadAt(buf, int64(version-1)*metaRecordSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("version %d not found", version)
+		}
+		return nil, fmt.Errorf("failed to read meta record of the version %d: %w", version, err)
+	}
+	var record metaRecord
+	if !record.Unmarshal(buf) {
+		return nil, fmt.Errorf("meta record of the version %d is corrupted", version)
+	}
+	if record.size == 0 {
+		return nil, nil
+	}
+	encrypted := record.size&metaEncrypted > 0
+	size := record.size &^ metaEncrypted
+	body := make([]byte, size+4)
+	n, err := s.values.ReadAt(body, record.index, record.offset)
+	if n != len(body) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read metadata of the version %d: %w", version, err)
+	}
+	if crcSum32(body[:size]) != order.Uint32(body[size:]) {
+		return nil, fmt.Errorf("metadata of the version %d is corrupted", version)
+	}
+	if !encrypted {
+		return body[:size], nil
+	}
+	if s.aead == nil {
+		return nil, fmt.Errorf("metadata of the version %d is encrypted, but encryption key is not configured", version)
+	}
+	if int(size) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("metadata of the version %d is corrupted", version)
+	}
+	nonce := body[:s.aead.NonceSize()]
+	meta, err := s.aead.Open(nil, nonce, body[len(nonce):size], record.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt metadata of the version %d: %w", version, err)
+	}
+	return meta, nil
+}
+
+// restoreMeta makes meta file consistent with the version file. Records after the last version are removed,
+// versions without records, e.g. written by older versions of the store, get empty records.
+func (s *FileStore) restoreMeta() error {
+	size, err := s.meta.Size()
+	if err != nil {
+		return err
+	}
+	expected := int64(s.versionOffset.Size()/versionRecordSize) * metaRecordSize
+	if size > expected {
+		return s.meta.Truncate(expected)
+	}
+	if size == expected {
+		return nil
+	}
+	size -= size % metaRecordSize
+	if err := s.meta.Truncate(size); err != nil {
+		return err
+	}
+	buf := make([]byte, expected-size)
+	for off := 0; off < len(buf); off += metaRecordSize {
+		(&metaRecord{}).MarshalTo(buf[off:])
+	}
+	if _, err := s.meta.Write(buf); err != nil {
+		return err
+	}
+	return s.meta.Commit()
+}
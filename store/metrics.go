@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value. It is safe to use from multiple goroutines.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Load() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value that can go up and down. It is safe to use from multiple goroutines.
+type Gauge struct {
+	v uint64
+}
+
+func (g *Gauge) Set(v uint64) {
+	atomic.StoreUint64(&g.v, v)
+}
+
+func (g *Gauge) Load() uint64 {
+	return atomic.LoadUint64(&g.v)
+}
+
+// Timer counts operations and their total duration. It is safe to use from multiple goroutines.
+type Timer struct {
+	count, total uint64
+}
+
+func (t *Timer) Observe(d time.Duration) {
+	atomic.AddUint64(&t.count, 1)
+	atomic.AddUint64(&t.total, uint64(d))
+}
+
+// Since observes the time elapsed since start.
+func (t *Timer) Since(start time.Time) {
+	t.Observe(time.Since(start))
+}
+
+func (t *Timer) Load() (uint64, time.Duration) {
+	return atomic.LoadUint64(&t.count), time.Duration(atomic.LoadUint64(&t.total))
+}
+
+type MetricKind uint8
+
+const (
+	CounterMetric MetricKind = iota
+	GaugeMetric
+	TimerMetric
+)
+
+// Metric is a sample of a single metric.
+type Metric struct {
+	Name, Help string
+	Kind       MetricKind
+	// Value of the counter or the gauge, or the number of observations of the timer.
+	Value uint64
+	// Total is the total duration of the observations of the timer.
+	Total time.Duration
+}
+
+// Metric returns a sample of the counter.
+func (c *Counter) Metric(name, help string) Metric {
+	return Metric{Name: name, Help: help, Kind: CounterMetric, Value: c.Load()}
+}
+
+// Metric returns a sample of the gauge.
+func (g *Gauge) Metric(name, help string) Metric {
+	return Metric{Name: name, Help: help, Kind: GaugeMetric, Value: g.Load()}
+}
+
+// Metric returns a sample of the timer.
+func (t *Timer) Metric(name, help string) Metric {
+	count, total := t.Load()
+	return Metric{Name: name, Help: help, Kind: TimerMetric, Value: count, Total: total}
+}
+
+// MetricsCollector is implemented by components that export metrics, e.g. by FileStore and Tree.
+type MetricsCollector interface {
+	CollectMetrics(func(Metric))
+}
+
+// WriteMetricsText writes metrics in the prometheus text format. Timer is written as a summary
+// with the number of observations and their total duration in seconds.
+func WriteMetricsText(w io.Writer, c MetricsCollector) error {
+	bw := bufio.NewWriter(w)
+	c.CollectMetrics(func(m Metric) {
+		switch m.Kind {
+		case CounterMetric:
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.Name, m.Help, m.Name, m.Name, m.Value)
+		case GaugeMetric:
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.Name, m.Help, m.Name, m.Name, m.Value)
+		case TimerMetric:
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s summary\n%s_sum %g\n%s_count %d\n",
+				m.Name, m.Help, m.Name, m.Name, m.Total.Seconds(), m.Name, m.Value)
+		}
+	})
+	return bw.Flush()
+}
+
+// PublishMetrics exports metrics with expvar as a map under the name. Timer is exported as
+// an object with the number of observations and their total duration in seconds.
+// Panics if the name is already used, same as expvar.Publish.
+func PublishMetrics(name string, c MetricsCollector) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		rst := map[string]interface{}{}
+		c.CollectMetrics(func(m Metric) {
+			if m.Kind == TimerMetric {
+				rst[m.Name] = map[string]interface{}{
+					"count": m.Value,
+					"sum":   m.Total.Seconds(),
+				}
+				return
+			}
+			rst[m.Name] = m.Value
+		})
+		return rst
+	}))
+}
+
+// storeMetrics are updated by the store and collected concurrently.
+type storeMetrics struct {
+	treeWritten, valueWritten, versionWritten Counter
+	treeReads, valueReads                     Timer
+	treeFsync, valueFsync, versionFsync       Timer
+	commits                                   Timer
+	durableVersion                            Gauge
+}
+
+// CollectMetrics reports metrics of the store. Can be called concurrently with other methods.
+func (s *FileStore) CollectMetrics(f func(Metric)) {
+	m := s.metrics
+	f(m.treeWritten.Metric("urkel_store_tree_written_bytes_total", "Bytes written to the tree group."))
+	f(m.valueWritten.Metric("urkel_store_value_written_bytes_total", "Bytes written to the value group."))
+	f(m.versionWritten.Metric("urkel_store_version_written_bytes_total", "Bytes written to the version file."))
+	f(m.treeReads.Metric("urkel_store_tree_read_seconds", "Reads from the tree group."))
+	f(m.valueReads.Metric("urkel_store_value_read_seconds", "Reads from the value group."))
+	f(m.treeFsync.Metric("urkel_store_tree_fsync_seconds", "Flush and fsync of the tree group on commit."))
+	f(m.valueFsync.Metric("urkel_store_value_fsync_seconds", "Flush and fsync of the value group on commit."))
+	f(m.versionFsync.Metric("urkel_store_version_fsync_seconds", "Fsync of the version file on commit."))
+	f(m.commits.Metric("urkel_store_commit_seconds", "Commits of the store, including every fsync."))
+	f(m.durableVersion.Metric("urkel_store_durable_version", "The latest version that is known to be durable."))
+	if s.cache != nil {
+		var stats GroupStats
+		s.cache.ReadStats(&stats)
+		f(Metric{Name: "urkel_store_cache_hits_total", Help: "Nodes found in the node cache.",
+			Kind: CounterMetric, Value: stats.CacheHit})
+		f(Metric{Name: "urkel_store_cache_misses_total", Help: "Nodes not found in the node cache.",
+			Kind: CounterMetric, Value: stats.CacheMiss})
+	}
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var errMmapUnsupported = errors.New("mmap is not supported")
+
+// mapped is a read-only memory mapping of a sealed file. Mapping is referenced by every read that
+// is in progress, Close unmaps it after the last reference is released.
+type mapped struct {
+	data []byte
+
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+// acquire must be called before the mapping is read. Caller must ensure that mapping is not closed.
+func (m *mapped) acquire() {
+	m.mu.Lock()
+	m.refs++
+	m.mu.Unlock()
+}
+
+// release unmaps closed mapping if it is the last reference.
+func (m *mapped) release() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs--
+	if m.closed && m.refs == 0 {
+		return m.unmap()
+	}
+	return nil
+}
+
+func (m *mapped) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, m.data[off:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// View returns bytes directly from the mapping, without copying.
+func (m *mapped) View(off int64, size int) ([]byte, error) {
+	if off < 0 || off+int64(size) > int64(len(m.data)) {
+		return nil, fmt.Errorf("%w: view %d:%d is out of mapped range %d", io.ErrUnexpectedEOF, off, size, len(m.data))
+	}
+	return m.data[off : off+int64(size) : off+int64(size)], nil
+}
+
+func (m *mapped) ReadStats(*GroupStats) {}
+
+// Close unmaps the mapping or defers it until reads that are in progress are finished.
+func (m *mapped) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.refs > 0 {
+		return nil
+	}
+	return m.unmap()
+}
+
+func (m *mapped) unmap() error {
+	if m.data == nil {
+		return nil
+	}
+	err := munmap(m.data)
+	m.data = nil
+	return err
+}
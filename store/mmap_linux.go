@@ -0,0 +1,29 @@
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(f *file) (*mapped, error) {
+	fd, ok := f.fd.(*os.File)
+	if !ok {
+		return nil, errMmapUnsupported
+	}
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return &mapped{}, nil
+	}
+	data, err := syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mapped{data: data}, nil
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
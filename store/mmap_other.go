@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package store
+
+func mmapFile(f *file) (*mapped, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	oplogPrefix = "oplog"
+	// op size, crc
+	opOverhead = 4 + 4
+)
+
+// OpLog is an append-only log of operations that are not committed yet. Log is opaque to the store,
+// it only checks integrity of every operation.
+type OpLog interface {
+	// Append adds operation to the log, it becomes durable only on the next fsync of the log.
+	Append(op []byte) error
+	// Replay calls f for every intact operation in the order they were appended.
+	// Torn operations at the end of the log are discarded.
+	Replay(f func(op []byte) error) error
+	// Truncate removes all operations.
+	Truncate() error
+}
+
+// OpLogger is implemented by backends that keep a log of operations.
+type OpLogger interface {
+	// OpLog returns nil if the log is disabled.
+	OpLog() OpLog
+}
+
+// OperationLog returns log of the backend, or nil if the log is not supported or disabled.
+func OperationLog(b Backend) OpLog {
+	if l, ok := b.(OpLogger); ok {
+		return l.OpLog()
+	}
+	return nil
+}
+
+// OpLog returns log of operations from the store directory, nil if it is disabled in the config.
+func (s *FileStore) OpLog() OpLog {
+	if s.oplog == nil {
+		return nil
+	}
+	return s.oplog
+}
+
+func openOpLog(dir *Dir) (*opLog, error) {
+	f, err := dir.Open(oplogPrefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &opLog{f: f, size: size}, nil
+}
+
+// opLog is a single file with operations, every operation is prefixed with its size and followed by crc.
+// Log is shared by all generations.
+type opLog struct {
+	f    *file
+	size int64
+	buf  []byte
+}
+
+func (l *opLog) Append(op []byte) error {
+	size := len(op) + opOverhead
+	if cap(l.buf) < size {
+		l.buf = make([]byte, size)
+	}
+	buf := l.buf[:size]
+	order.PutUint32(buf, uint32(len(op)))
+	copy(buf[4:], op)
+	putCrcSum32(buf[4+len(op):], buf[:4+len(op)])
+	n, err := l.f.Write(buf)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("incomplete operation write")
+	}
+	return nil
+}
+
+func (l *opLog) Replay(f func(op []byte) error) error {
+	var (
+		r      = bufio.NewReader(io.NewSectionReader(l.f, 0, l.size))
+		header = make([]byte, 4)
+		off    int64
+	)
+	for off < l.size {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return l.discard(off, err)
+		}
+		size := int64(order.Uint32(header))
+		if off+size+opOverhead > l.size {
+			return l.discard(off, io.ErrUnexpectedEOF)
+		}
+		buf := make([]byte, 4+size+4)
+		copy(buf, header)
+		if _, err := io.ReadFull(r, buf[4:]); err != nil {
+			return l.discard(off, err)
+		}
+		if crcSum32(buf[:4+size]) != order.Uint32(buf[4+size:]) {
+			return l.discard(off, nil)
+		}
+		if err := f(buf[4 : 4+size]); err != nil {
+			return err
+		}
+		off += size + opOverhead
+	}
+	return nil
+}
+
+// discard truncates torn operations starting at the offset. Only incomplete reads are expected.
+func (l *opLog) discard(off int64, err error) error {
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if err := l.f.Truncate(off); err != nil {
+		return err
+	}
+	l.size = off
+	return nil
+}
+
+func (l *opLog) Truncate() error {
+	if l.size == 0 {
+		return nil
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+func (l *opLog) Close() error {
+	return l.f.Close()
+}
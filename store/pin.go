@@ -0,0 +1,42 @@
+package store
+
+import "sync"
+
+func newPinned() *pinned {
+	return &pinned{nodes: map[uint64]interface{}{}}
+}
+
+// pinned keeps decoded nodes until they are unpinned. It is safe to use from multiple goroutines.
+type pinned struct {
+	mu    sync.RWMutex
+	nodes map[uint64]interface{}
+}
+
+func (p *pinned) Get(idx, pos uint32) (interface{}, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	node, exist := p.nodes[cacheKey(idx, pos)]
+	return node, exist
+}
+
+func (p *pinned) Add(idx, pos uint32, node interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nodes[cacheKey(idx, pos)] = node
+}
+
+func (p *pinned) Remove(idx, pos uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.nodes, cacheKey(idx, pos))
+}
+
+// PinNode keeps decoded node at the position until it is unpinned, e.g. until the node is durable.
+func (s *FileStore) PinNode(index, off uint32, node interface{}) {
+	s.pinned.Add(index, off, node)
+}
+
+// UnpinNode removes pinned node at the position.
+func (s *FileStore) UnpinNode(index, off uint32) {
+	s.pinned.Remove(index, off)
+}
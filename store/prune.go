@@ -0,0 +1,74 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+const prunePrefix = "prune"
+
+// ErrPruned returned when requested version was removed by retention policy or an explicit prune.
+var ErrPruned = errors.New("version pruned")
+
+// PrunedVersion returns the latest pruned version. Every version up to and including it is not readable.
+func (s *FileStore) PrunedVersion() uint64 {
+	return s.pruned.Load()
+}
+
+// RetentionLimit returns the latest version that must be pruned according to the retention policy
+// in the config, given that last is the most recent committed version.
+// If both policies are set the one that keeps more versions wins.
+func (s *FileStore) RetentionLimit(last uint64) uint64 {
+	if last == 0 {
+		return 0
+	}
+	var limit uint64
+	if s.conf.KeepVersions > 0 && last > s.conf.KeepVersions {
+		limit = last - s.conf.KeepVersions
+	}
+	if s.conf.KeepNewerThan > 0 {
+		upTo := s.conf.KeepNewerThan
+		if upTo >= last {
+			upTo = last - 1
+		}
+		if s.conf.KeepVersions == 0 || upTo < limit {
+			limit = upTo
+		}
+	}
+	return limit
+}
+
+// PruneVersions makes all versions up to and including upTo unreadable.
+// Watermark is written only if it is moved, and fsynced with the next durable commit, see Sync.
+func (s *FileStore) PruneVersions(upTo uint64) error {
+	if upTo <= s.pruned.Load() {
+		return nil
+	}
+	if s.conf.ReadOnly {
+		return ErrReadOnly
+	}
+	return s.pruned.Set(upTo)
+}
+
+// restorePruned lowers the watermark if versions up to it were lost on crash. Watermark may be ahead
+// of the recovered versions if they were pruned explicitly before they became durable.
+func (s *FileStore) restorePruned() error {
+	last := s.versionOffset.Size() / versionRecordSize
+	if last == 0 || s.pruned.Load() < last {
+		return nil
+	}
+	// the latest version is never pruned
+	if s.conf.ReadOnly {
+		atomic.StoreUint64(&s.pruned.value, last-1)
+		return nil
+	}
+	return s.pruned.Store(last - 1)
+}
+
+func (s *FileStore) checkPruned(version uint64) error {
+	if pruned := s.pruned.Load(); version <= pruned {
+		return fmt.Errorf("%w: version %d, pruned up to %d", ErrPruned, version, pruned)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	commitPrefix = "commit"
+	// tree index, tree offset, value index, value offset, version file offset, tree crc, value crc, crc
+	commitRecordSize = 4 + 4 + 4 + 4 + 8 + 4 + 4 + 4
+
+	// layout of the version record and the root node written by the trie.
+	// used only to validate state on open.
+	versionRecordSize = 8 + 4 + 4 + 32 + 4
+	rootRecordSize    = 2 + 2*4 + 2*4 + 2*32 + 4
+)
+
+// Recovery describes data that was discarded on open. Non-zero counters mean that the last
+// commit was interrupted, e.g. by a crash or power loss.
+type Recovery struct {
+	// Version is the latest version that was found intact.
+	Version uint64
+	// Number of bytes discarded from each file group.
+	VersionBytes, TreeBytes, ValueBytes, CommitBytes uint64
+}
+
+// Discarded returns true if any data was discarded.
+func (r Recovery) Discarded() bool {
+	return r.VersionBytes+r.TreeBytes+r.ValueBytes+r.CommitBytes > 0
+}
+
+// commitRecord is written after every commit and points to the end of the data in every file group.
+type commitRecord struct {
+	treeIndex, treeOffset   uint32
+	valueIndex, valueOffset uint32
+	versionOffset           uint64
+	// relaxed is true if data referenced by the record may not be durable
+	relaxed bool
+	// treeSum and valueSum are checksums of the bytes written after the previous record,
+	// they are used to check data of the relaxed record on recovery
+	treeSum, valueSum uint32
+}
+
+func (c *commitRecord) MarshalTo(buf []byte) {
+	order.PutUint32(buf, c.treeIndex)
+	order.PutUint32(buf[4:], c.treeOffset)
+	order.PutUint32(buf[8:], c.valueIndex)
+	order.PutUint32(buf[12:], c.valueOffset)
+	versionOffset := c.versionOffset
+	if c.relaxed {
+		versionOffset |= relaxedCommit
+	}
+	order.PutUint64(buf[16:], versionOffset)
+	order.PutUint32(buf[24:], c.treeSum)
+	order.PutUint32(buf[28:], c.valueSum)
+	putCrcSum32(buf[32:], buf[:32])
+}
+
+func (c *commitRecord) Unmarshal(buf []byte) bool {
+	if crcSum32(buf[:32]) != order.Uint32(buf[32:]) {
+		return false
+	}
+	c.treeIndex = order.Uint32(buf)
+	c.treeOffset = order.Uint32(buf[4:])
+	c.valueIndex = order.Uint32(buf[8:])
+	c.valueOffset = order.Uint32(buf[12:])
+	c.versionOffset = order.Uint64(buf[16:]) &^ relaxedCommit
+	c.relaxed = order.Uint64(buf[16:])&relaxedCommit != 0
+	c.treeSum = order.Uint32(buf[24:])
+	c.valueSum = order.Uint32(buf[28:])
+	return true
+}
+
+// writeCommit appends commit record with the current end of every group. Durable record is fsynced,
+// it must be written after all groups were made durable.
+func (s *FileStore) writeCommit(durable bool) error {
+	record := commitRecord{relaxed: !durable}
+	record.treeIndex, record.treeOffset = s.trees.offset.Offset()
+	record.valueIndex, record.valueOffset = s.values.offset.Offset()
+	record.versionOffset = s.versionOffset.Size()
+	record.treeSum, record.valueSum = s.treeSum, s.valueSum
+	buf := make([]byte, commitRecordSize)
+	record.MarshalTo(buf)
+	n, err := s.commits.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("incomplete commit record write")
+	}
+	s.treeSum, s.valueSum = 0, 0
+	if !durable {
+		return nil
+	}
+	return s.commits.Commit()
+}
+
+// recover finds the latest commit that is intact and truncates everything that was written after it.
+// If store doesn't have commit records, e.g. it was created by an older version, only the version file
+// is checked. Read-only store only reports discarded data, files are not truncated.
+func (s *FileStore) recover() error {
+	size, err := s.commits.Size()
+	if err != nil {
+		return err
+	}
+	var (
+		record commitRecord
+		found  bool
+		buf    = make([]byte, commitRecordSize)
+		off    = size - size%commitRecordSize
+	)
+	for ; off > 0; off -= commitRecordSize {
+		if _, err := s.commits.ReadAt(buf, off-commitRecordSize); err != nil {
+			return err
+		}
+		if !record.Unmarshal(buf) {
+			continue
+		}
+		valid, err := s.validCommit(&record)
+		if err != nil {
+			return err
+		}
+		if valid {
+			found = true
+			break
+		}
+	}
+	if found && record.relaxed {
+		// relaxed record may reach the disk before the data it references
+		s.recovery.Version = 0
+		var intact bool
+		if record, off, intact, err = s.intactCommit(off, record); err != nil {
+			return err
+		}
+		if intact {
+			if intact, err = s.validCommit(&record); err != nil {
+				return err
+			}
+		}
+		if !intact {
+			// same as the durable commit if there are none
+			record, off = commitRecord{}, 0
+		}
+	}
+	if off < size {
+		s.recovery.CommitBytes = uint64(size - off)
+		if !s.conf.ReadOnly {
+			if err := s.commits.Truncate(off); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		if err := s.recoverVersions(); err != nil {
+			return err
+		}
+		s.metrics.durableVersion.Set(s.versionOffset.Size() / versionRecordSize)
+		if s.conf.ReadOnly || s.versionOffset.Size() == 0 {
+			return nil
+		}
+		// data of the following relaxed commits is checked starting from this record
+		return s.writeCommit(true)
+	}
+	if err := s.truncateVersions(record.versionOffset); err != nil {
+		return err
+	}
+	durable, err := s.durableCommit(off-commitRecordSize, record)
+	if err != nil {
+		return err
+	}
+	s.metrics.durableVersion.Set(durable.versionOffset / versionRecordSize)
+	discarded, err := s.truncateGroup(s.trees, record.treeIndex, record.treeOffset)
+	if err != nil {
+		return err
+	}
+	s.recovery.TreeBytes = discarded
+	discarded, err = s.truncateGroup(s.values, record.valueIndex, record.valueOffset)
+	if err != nil {
+		return err
+	}
+	s.recovery.ValueBytes = discarded
+	return nil
+}
+
+// truncateGroup removes data after the offset from the group, read-only store only moves the end of the group.
+func (s *FileStore) truncateGroup(fg *filesGroup, index, offset uint32) (uint64, error) {
+	if s.conf.ReadOnly {
+		return fg.tail(index, offset)
+	}
+	return fg.truncate(index, offset)
+}
+
+// durableCommit returns the latest durable commit record, starting from the last record and going back
+// from the offset in the commit file. Records that were written without fsync are checked only by validCommit,
+// everything that precedes the durable record is durable as well. Empty record is returned if there are none.
+func (s *FileStore) durableCommit(off int64, last commitRecord) (commitRecord, error) {
+	var (
+		record = last
+		buf    = make([]byte, commitRecordSize)
+	)
+	for ; record.relaxed; off -= commitRecordSize {
+		if off <= 0 {
+			return commitRecord{}, nil
+		}
+		if _, err := s.commits.ReadAt(buf, off-commitRecordSize); err != nil {
+			return commitRecord{}, err
+		}
+		if !record.Unmarshal(buf) {
+			return commitRecord{}, nil
+		}
+	}
+	return record, nil
+}
+
+// intactCommit returns the latest commit record, not newer than the relaxed record before the offset,
+// whose data is intact, and the offset right after it. Data written by every relaxed commit since the last
+// durable one is read and compared with the checksums in the records, data of the store without durable
+// records is checked from the start. False is returned if neither a relaxed nor a durable record can be used.
+func (s *FileStore) intactCommit(off int64, last commitRecord) (commitRecord, int64, bool, error) {
+	type relaxedRecord struct {
+		record commitRecord
+		off    int64
+	}
+	var (
+		chain   = []relaxedRecord{{last, off}}
+		base    commitRecord
+		baseOff int64
+		found   bool
+		buf     = make([]byte, commitRecordSize)
+	)
+	for prev := off - commitRecordSize; prev > 0; prev -= commitRecordSize {
+		if _, err := s.commits.ReadAt(buf, prev-commitRecordSize); err != nil {
+			return base, 0, false, err
+		}
+		var record commitRecord
+		if !record.Unmarshal(buf) {
+			// data of the following records can't be checked without the start of their data
+			chain = chain[:0]
+			continue
+		}
+		if !record.relaxed {
+			base, baseOff, found = record, prev, true
+			break
+		}
+		chain = append(chain, relaxedRecord{record, prev})
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		intact, err := s.intactData(base, chain[i].record)
+		if err != nil {
+			return base, 0, false, err
+		}
+		if !intact {
+			break
+		}
+		base, baseOff, found = chain[i].record, chain[i].off, true
+	}
+	return base, baseOff, found, nil
+}
+
+// intactData checks tree and value bytes and version records written between two commit records.
+func (s *FileStore) intactData(prev, record commitRecord) (bool, error) {
+	if record.versionOffset < prev.versionOffset {
+		return false, nil
+	}
+	for _, group := range []struct {
+		fg                    *filesGroup
+		fromIndex, fromOffset uint32
+		toIndex, toOffset     uint32
+		sum                   uint32
+	}{
+		{s.trees, prev.treeIndex, prev.treeOffset, record.treeIndex, record.treeOffset, record.treeSum},
+		{s.values, prev.valueIndex, prev.valueOffset, record.valueIndex, record.valueOffset, record.valueSum},
+	} {
+		sum, complete, err := group.fg.checksum(group.fromIndex, group.fromOffset, group.toIndex, group.toOffset)
+		if err != nil || !complete || sum != group.sum {
+			return false, err
+		}
+	}
+	buf := make([]byte, versionRecordSize)
+	for off := prev.versionOffset; off+versionRecordSize <= record.versionOffset; off += versionRecordSize {
+		if _, err := s.versions.ReadAt(buf, int64(off)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+			return false, err
+		}
+		if crcSum32(buf[:48]) != order.Uint32(buf[48:]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// validCommit checks that every group has all data referenced by the commit record
+// and that the last version record and its root are intact.
+func (s *FileStore) validCommit(record *commitRecord) (bool, error) {
+	if record.versionOffset > s.versionOffset.Size() {
+		return false, nil
+	}
+	for _, group := range []struct {
+		fg            *filesGroup
+		index, offset uint32
+	}{
+		{s.trees, record.treeIndex, record.treeOffset},
+		{s.values, record.valueIndex, record.valueOffset},
+	} {
+		index, offset := group.fg.offset.Offset()
+		if group.index > index || (group.index == index && group.offset > offset) {
+			return false, nil
+		}
+	}
+	if record.versionOffset == 0 {
+		return true, nil
+	}
+	if record.versionOffset < versionRecordSize {
+		return false, nil
+	}
+	return s.validVersion(int64(record.versionOffset) - versionRecordSize)
+}
+
+// validVersion checks version record at the offset and its root node.
+func (s *FileStore) validVersion(off int64) (bool, error) {
+	buf := make([]byte, versionRecordSize)
+	if _, err := s.versions.ReadAt(buf, off); err != nil {
+		return false, err
+	}
+	if crcSum32(buf[:48]) != order.Uint32(buf[48:]) {
+		return false, nil
+	}
+	idx, pos := order.Uint32(buf[8:]), order.Uint32(buf[12:])
+	root := make([]byte, rootRecordSize)
+	n, err := s.trees.ReadAt(root, idx, pos)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("failed to read root of the version %d: %w", order.Uint64(buf), err)
+	}
+	if n != len(root) || crcSum32(root[:rootRecordSize-4]) != order.Uint32(root[rootRecordSize-4:]) {
+		return false, nil
+	}
+	s.recovery.Version = order.Uint64(buf)
+	return true, nil
+}
+
+// recoverVersions scans version file backwards for the last intact version.
+func (s *FileStore) recoverVersions() error {
+	size := int64(s.versionOffset.Size())
+	off := size - size%versionRecordSize
+	for ; off > 0; off -= versionRecordSize {
+		valid, err := s.validVersion(off - versionRecordSize)
+		if err != nil {
+			return err
+		}
+		if valid {
+			break
+		}
+	}
+	return s.truncateVersions(uint64(off))
+}
+
+func (s *FileStore) truncateVersions(off uint64) error {
+	size := s.versionOffset.Size()
+	if off >= size {
+		return nil
+	}
+	if !s.conf.ReadOnly {
+		if err := s.versions.Truncate(int64(off)); err != nil {
+			return err
+		}
+	}
+	s.recovery.VersionBytes = size - off
+	s.versionOffset = newOffset(0, uint32(off), versionFileSize)
+	return nil
+}
+
+// Recovery returns description of the data that was discarded on open.
+func (s *FileStore) Recovery() Recovery {
+	return s.recovery
+}
@@ -0,0 +1,94 @@
+package store
+
+import "fmt"
+
+// Rollbacker is implemented by backends that can remove the latest versions.
+type Rollbacker interface {
+	Rollback(version uint64, truncate bool) error
+}
+
+// Rollback removes version records after the version, the next written version record becomes version+1.
+// If truncate is true tree and value records that were written after the version are removed as well,
+// otherwise they remain in the files until compaction. Data is truncated only if the version was committed
+// with a commit record, stores created by older versions keep the data.
+// Everything is made durable before return. Must not be called concurrently with compaction or checkpoint.
+func (s *FileStore) Rollback(version uint64, truncate bool) error {
+	last := s.versionOffset.Size() / versionRecordSize
+	if version > last {
+		return fmt.Errorf("can't rollback to version %d, latest version is %d", version, last)
+	}
+	if pruned := s.pruned.Load(); pruned > 0 && version <= pruned {
+		return fmt.Errorf("%w: can't rollback to version %d, pruned up to %d", ErrPruned, version, pruned)
+	}
+	// groups must not have dirty writers when files are truncated
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	end := version * versionRecordSize
+	record, off, err := s.commitBefore(end)
+	if err != nil {
+		return err
+	}
+	if err := s.commits.Truncate(off); err != nil {
+		return err
+	}
+	f, err := s.getVersionFile()
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(end)); err != nil {
+		return err
+	}
+	s.versionOffset = newOffset(0, uint32(end), versionFileSize)
+	if err := s.meta.Truncate(int64(version) * metaRecordSize); err != nil {
+		return err
+	}
+	// entries of removed versions stay in the index, they are filtered by VersionsByRoot
+	s.roots.truncate(version)
+	if err := s.roots.sync(); err != nil {
+		return err
+	}
+	if truncate && off > 0 && record.versionOffset == end {
+		if _, err := s.trees.truncate(record.treeIndex, record.treeOffset); err != nil {
+			return err
+		}
+		if _, err := s.values.truncate(record.valueIndex, record.valueOffset); err != nil {
+			return err
+		}
+		// positions of removed nodes and values will be reused
+		if s.cache != nil {
+			s.cache.Purge()
+		}
+		if s.dedup != nil {
+			s.dedup = newDedupIndex(s.conf.DedupIndexSize)
+		}
+	}
+	// next commit record must point after the data that was kept
+	if err := s.writeCommit(true); err != nil {
+		return err
+	}
+	s.metrics.durableVersion.Set(version)
+	return s.dir.Commit()
+}
+
+// commitBefore returns the latest commit record that doesn't reference version records after the offset,
+// and the offset in the commit file right after it. Zero offset is returned if there is no such record.
+func (s *FileStore) commitBefore(end uint64) (commitRecord, int64, error) {
+	var (
+		record commitRecord
+		buf    = make([]byte, commitRecordSize)
+	)
+	size, err := s.commits.Size()
+	if err != nil {
+		return record, 0, err
+	}
+	for off := size - size%commitRecordSize; off > 0; off -= commitRecordSize {
+		if _, err := s.commits.ReadAt(buf, off-commitRecordSize); err != nil {
+			return record, 0, err
+		}
+		if record.Unmarshal(buf) && record.versionOffset <= end {
+			return record, off, nil
+		}
+	}
+	return record, 0, nil
+}
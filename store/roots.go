@@ -0,0 +1,311 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	rootsPrefix = "roots"
+	// root hash, version, crc
+	rootSlotSize = 32 + 8 + 4
+	// header is a slot with the number of indexed versions and the number of used slots
+	rootHeaderSize = rootSlotSize
+	// number of slots in a new index, must be a power of two
+	initialRootSlots = 1 << 10
+)
+
+// RootIndex is implemented by backends that index versions by the root hash.
+type RootIndex interface {
+	// VersionsByRoot returns readable versions with the root hash in ascending order.
+	VersionsByRoot(hash []byte) ([]uint64, error)
+}
+
+// rootIndex is a hash table with open addressing in a single file. Slot is selected by the first 8 bytes
+// of the root hash, collisions are resolved with linear probing. Versions are never removed from the index,
+// every candidate is checked against the version record, therefore the index may have entries for
+// versions that were discarded by recovery or rollback.
+//
+// Entries are written without fsync. Header has the number of versions that were indexed before the
+// previous fsync of the index, versions after it are indexed again on open. Index is rebuilt from
+// the version file if the header is corrupted.
+type rootIndex struct {
+	dir   *Dir
+	index uint32
+	f     *file
+	slots uint64
+	// used is the number of used slots
+	used uint64
+	// indexed is the number of versions that are indexed, durable is the number of versions that were
+	// indexed before the last fsync
+	indexed, durable uint64
+}
+
+func openRootIndex(dir *Dir) (*rootIndex, error) {
+	index, err := dir.LastIndex(rootsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	f, err := dir.openRandom(rootsPrefix, index)
+	if err != nil {
+		return nil, err
+	}
+	r := &rootIndex{dir: dir, index: index, f: f}
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size < rootHeaderSize+rootSlotSize {
+		return r, r.reset()
+	}
+	slots := uint64(size-rootHeaderSize) / rootSlotSize
+	if slots&(slots-1) != 0 {
+		return r, r.reset()
+	}
+	header := make([]byte, rootHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if crcSum32(header[:16]) != order.Uint32(header[16:]) {
+		return r, r.reset()
+	}
+	r.slots = slots
+	r.indexed = order.Uint64(header)
+	r.used = order.Uint64(header[8:])
+	r.durable = r.indexed
+	return r, nil
+}
+
+// reset removes all entries.
+func (r *rootIndex) reset() error {
+	if err := r.f.Truncate(0); err != nil {
+		return err
+	}
+	if err := r.f.Truncate(rootHeaderSize + initialRootSlots*rootSlotSize); err != nil {
+		return err
+	}
+	r.slots, r.used, r.indexed, r.durable = initialRootSlots, 0, 0, 0
+	return nil
+}
+
+// add indexes the next version. Version is ignored if it is already in the index.
+func (r *rootIndex) add(hash []byte, version uint64) error {
+	if (r.used+1)*2 > r.slots {
+		if err := r.grow(); err != nil {
+			return err
+		}
+	}
+	added, err := r.insert(hash, version)
+	if err != nil {
+		return err
+	}
+	if added {
+		r.used++
+	}
+	r.indexed = version
+	return nil
+}
+
+func (r *rootIndex) insert(hash []byte, version uint64) (bool, error) {
+	slot := make([]byte, rootSlotSize)
+	for i, pos := uint64(0), r.slotFor(hash); i < r.slots; i, pos = i+1, (pos+1)&(r.slots-1) {
+		off := rootHeaderSize + int64(pos)*rootSlotSize
+		if _, err := r.f.ReadAt(slot, off); err != nil {
+			return false, err
+		}
+		if order.Uint64(slot[32:]) == 0 {
+			copy(slot, hash)
+			order.PutUint64(slot[32:], version)
+			putCrcSum32(slot[40:], slot[:40])
+			_, err := r.f.WriteAt(slot, off)
+			return err == nil, err
+		}
+		if validRootSlot(slot) && order.Uint64(slot[32:]) == version && bytes.Equal(slot[:32], hash) {
+			return false, nil
+		}
+	}
+	return false, errors.New("root index is full")
+}
+
+// lookup returns versions from the index with the root hash.
+func (r *rootIndex) lookup(hash []byte) ([]uint64, error) {
+	var (
+		rst  []uint64
+		slot = make([]byte, rootSlotSize)
+	)
+	for i, pos := uint64(0), r.slotFor(hash); i < r.slots; i, pos = i+1, (pos+1)&(r.slots-1) {
+		if _, err := r.f.ReadAt(slot, rootHeaderSize+int64(pos)*rootSlotSize); err != nil {
+			return nil, err
+		}
+		version := order.Uint64(slot[32:])
+		if version == 0 {
+			break
+		}
+		if validRootSlot(slot) && bytes.Equal(slot[:32], hash) {
+			rst = append(rst, version)
+		}
+	}
+	return rst, nil
+}
+
+func (r *rootIndex) slotFor(hash []byte) uint64 {
+	return order.Uint64(hash) & (r.slots - 1)
+}
+
+func validRootSlot(slot []byte) bool {
+	return crcSum32(slot[:40]) == order.Uint32(slot[40:])
+}
+
+// grow copies entries into a new file with twice as many slots and removes the current file.
+func (r *rootIndex) grow() error {
+	next := &rootIndex{dir: r.dir, index: r.index + 1, slots: r.slots * 2, indexed: r.indexed, durable: r.durable}
+	f, err := r.dir.openRandom(rootsPrefix, next.index)
+	if err != nil {
+		return err
+	}
+	next.f = f
+	if err := f.Truncate(rootHeaderSize + int64(next.slots)*rootSlotSize); err != nil {
+		return err
+	}
+	slot := make([]byte, rootSlotSize)
+	for pos := uint64(0); pos < r.slots; pos++ {
+		if _, err := r.f.ReadAt(slot, rootHeaderSize+int64(pos)*rootSlotSize); err != nil {
+			return err
+		}
+		if order.Uint64(slot[32:]) == 0 || !validRootSlot(slot) {
+			continue
+		}
+		added, err := next.insert(slot[:32], order.Uint64(slot[32:]))
+		if err != nil {
+			return err
+		}
+		if added {
+			next.used++
+		}
+	}
+	if err := next.sync(); err != nil {
+		return err
+	}
+	if err := r.dir.Commit(); err != nil {
+		return err
+	}
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := r.dir.RemoveFile(rootsPrefix, r.index); err != nil {
+		return err
+	}
+	*r = *next
+	return nil
+}
+
+// truncate forgets versions after the last version, they are indexed again when written.
+func (r *rootIndex) truncate(last uint64) {
+	if r.indexed > last {
+		r.indexed = last
+	}
+	if r.durable > last {
+		r.durable = last
+	}
+}
+
+// sync writes header with versions that were indexed before the previous sync and fsyncs the index.
+func (r *rootIndex) sync() error {
+	header := make([]byte, rootHeaderSize)
+	order.PutUint64(header, r.durable)
+	order.PutUint64(header[8:], r.used)
+	putCrcSum32(header[16:], header[:16])
+	if _, err := r.f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	r.f.dirty = true
+	if err := r.f.Commit(); err != nil {
+		return err
+	}
+	r.durable = r.indexed
+	return nil
+}
+
+func (r *rootIndex) close() error {
+	return r.f.Close()
+}
+
+// indexRoots adds version records that are not indexed yet, they were written after the last sync
+// of the index or the index was rebuilt.
+func (s *FileStore) indexRoots() error {
+	last := s.versionOffset.Size() / versionRecordSize
+	s.roots.truncate(last)
+	if s.roots.indexed == last {
+		return nil
+	}
+	const batch = 1024
+	buf := make([]byte, batch*versionRecordSize)
+	for version := s.roots.indexed + 1; version <= last; {
+		n := last - version + 1
+		if n > batch {
+			n = batch
+		}
+		records := buf[:n*versionRecordSize]
+		if _, err := s.versions.ReadAt(records, int64(version-1)*versionRecordSize); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if err := s.indexVersions(records, version); err != nil {
+			return err
+		}
+		version += n
+	}
+	return s.roots.sync()
+}
+
+// indexVersions adds version records to the root index, first record is the version.
+// Records that are not intact are skipped.
+func (s *FileStore) indexVersions(records []byte, version uint64) error {
+	for off := 0; off+versionRecordSize <= len(records); off, version = off+versionRecordSize, version+1 {
+		record := records[off : off+versionRecordSize]
+		if crcSum32(record[:48]) != order.Uint32(record[48:]) {
+			s.roots.indexed = version
+			continue
+		}
+		if err := s.roots.add(record[16:48], version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VersionsByRoot returns versions with the root hash. Versions are found in the index and checked against
+// version records, pruned versions are skipped.
+func (s *FileStore) VersionsByRoot(hash []byte) ([]uint64, error) {
+	if len(hash) != 32 {
+		return nil, fmt.Errorf("invalid root hash size %d", len(hash))
+	}
+	if s.roots == nil {
+		return nil, fmt.Errorf("%w: root index is not available", ErrReadOnly)
+	}
+	candidates, err := s.roots.lookup(hash)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		rst    []uint64
+		record = make([]byte, versionRecordSize)
+	)
+	for _, version := range candidates {
+		_, err := s.ReadVersion(version, record)
+		if errors.Is(err, ErrPruned) || errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if crcSum32(record[:48]) == order.Uint32(record[48:]) && order.Uint64(record) == version &&
+			bytes.Equal(record[16:48], hash) {
+			rst = append(rst, version)
+		}
+	}
+	sort.Slice(rst, func(i, j int) bool { return rst[i] < rst[j] })
+	return rst, nil
+}
@@ -1,34 +1,108 @@
 package store
 
 import (
+	"crypto/cipher"
 	"errors"
+	"hash/crc32"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
 const (
 	maxFileSize uint32 = 2 << 30
+	// versions are stored in a single file
+	versionFileSize uint32 = math.MaxUint32
 
-	versionPrefix = "version"
-	treePrefix    = "tree"
-	valuePrefix   = "value"
-	dbformat      = "udb"
+	defaultValueChunkSize = 64 << 20
+
+	versionPrefix    = "version"
+	treePrefix       = "tree"
+	valuePrefix      = "value"
+	generationPrefix = "generation"
+	dbformat         = "udb"
 )
 
 type Config struct {
-	Path                string
-	MaxFileSize         uint32
-	TreeWriteBuffer     int
-	ValueWriteBuffer    int
+	Path             string
+	MaxFileSize      uint32
+	TreeWriteBuffer  int
+	ValueWriteBuffer int
+	// ReadBufferChunkSize is the size of the aligned chunk that is read from a tree file
+	// and kept in memory to serve subsequent reads. Zero disables the read buffer.
 	ReadBufferChunkSize int
+	// ReadBufferChunks is the number of chunks kept in memory per tree file.
+	ReadBufferChunks int
+	// MmapTrees enables memory mapped reads from the tree files that reached MaxFileSize.
+	// Supported only on linux with a store on disk, otherwise regular reads are used.
+	MmapTrees bool
+	// MmapValues is the same as MmapTrees for value files.
+	MmapValues bool
+
+	// KeepVersions is the number of the most recent versions that remain readable,
+	// older versions are pruned on commit. Versions are counted from the latest durable version,
+	// see Durability. Zero disables the policy.
+	KeepVersions uint64
+	// KeepNewerThan prunes on commit every version that is older or equal to it,
+	// the latest version is never pruned. Zero disables the policy.
+	KeepNewerThan uint64
+
+	// NodeCacheSize is the approximate amount of memory in bytes used for caching decoded nodes.
+	// Zero disables the cache.
+	NodeCacheSize int
+
+	// ValueCodec encodes new values, e.g. Flate compresses them. Values that were written
+	// with any registered codec remain readable. Nil disables encoding.
+	ValueCodec Codec
+	// EncryptionKey enables AES-GCM encryption of new values, their preimages and metadata of versions.
+	// Key must be 16, 24 or 32 bytes long. Store with encrypted values can't be read without the key.
+	EncryptionKey []byte
+	// InlineValueSize is the maximum size of the encoded preimage and value that are stored
+	// in the tree file together with the leaf, instead of the value file. Zero disables inlining.
+	InlineValueSize int
+	// DedupIndexSize enables deduplication of values. New leaf reuses the body of the identical value
+	// if it is one of the DedupIndexSize most recently written or read values. Zero disables deduplication.
+	// Deduplication is best-effort: index is kept only in memory of the process and starts empty when
+	// the store is opened, identical values that were written before are reused only after they are read.
+	// Compaction fills the index of the new generation with the values it copies.
+	DedupIndexSize int
+	// ValueChunkSize is the size of the chunks for values that are larger than it. Chunk must fit into
+	// a value file, therefore it is limited by half of MaxFileSize. Zero selects 64MiB.
+	ValueChunkSize int
+
+	// Durability defines when commits are fsynced, see FileStore.DurableVersion.
+	// Every commit is fsynced by default.
+	Durability Durability
+	// SyncCommits is the maximum number of commits between fsyncs with DurabilityGroup. Zero disables the limit.
+	SyncCommits int
+	// SyncInterval is the maximum time between fsyncs with DurabilityGroup. Zero disables the limit.
+	// If both limits are zero every commit is fsynced.
+	SyncInterval time.Duration
+
+	// OpLog enables the log of tree modifications that are not committed yet, see Tree.LoadLatest.
+	// Operations are appended to the log without fsync, and encrypted if EncryptionKey is set.
+	OpLog bool
+
+	// ReadOnly opens the store without modifying any file. Data that recovery would discard is reported
+	// in Recovery but kept on disk and not read. Writes fail with ErrReadOnly, the root index and
+	// the operation log are not available.
+	ReadOnly bool
 }
 
+// ErrReadOnly returned by writes to the store that was opened with ReadOnly.
+var ErrReadOnly = errors.New("store is read-only")
+
 func DefaultConfig(path string) Config {
 	return Config{
-		Path:             path,
-		MaxFileSize:      maxFileSize,
-		TreeWriteBuffer:  16 << 20,
-		ValueWriteBuffer: 8 << 20,
+		Path:                path,
+		MaxFileSize:         maxFileSize,
+		TreeWriteBuffer:     16 << 20,
+		ValueWriteBuffer:    8 << 20,
+		ReadBufferChunkSize: 16 << 10,
+		ReadBufferChunks:    64,
+		NodeCacheSize:       64 << 20,
 	}
 }
 
@@ -41,30 +115,57 @@ func newFileStore(conf Config) (*FileStore, error) {
 	} else {
 		fs = afero.NewMemMapFs()
 	}
-	dir, err := OpenDir(fs, conf.Path)
+	var (
+		root *Dir
+		err  error
+	)
+	if conf.ReadOnly {
+		root, err = openReadOnlyDir(fs, conf.Path)
+	} else {
+		root, err = OpenDir(fs, conf.Path)
+	}
 	if err != nil {
 		return nil, err
 	}
 	store := &FileStore{
-		conf:          conf,
-		dir:           dir,
-		fs:            fs,
-		versionOffset: &Offset{maxFileSize: conf.MaxFileSize},
-		trees:         newGroup(treePrefix, dir, conf.MaxFileSize, conf.TreeWriteBuffer),
-		// don't use read buffer for values
-		values: newGroup(valuePrefix, dir, conf.MaxFileSize, conf.ValueWriteBuffer),
+		conf:     conf,
+		root:     root,
+		fs:       fs,
+		metrics:  &storeMetrics{},
+		pinned:   newPinned(),
+		lastSync: time.Now(),
+	}
+	if conf.NodeCacheSize > 0 {
+		store.cache = newCache(conf.NodeCacheSize)
+	}
+	if len(conf.EncryptionKey) > 0 {
+		store.aead, err = newValueCipher(conf.EncryptionKey)
+		if err != nil {
+			root.Close()
+			return nil, err
+		}
 	}
 	return store, nil
 }
 
 // Open initializes file store object and restores metadata from disk.
+// Data written after the last intact commit is discarded, see FileStore.Recovery.
+// Directory is locked until the store is closed, ErrLocked is returned if it is already locked.
 func Open(conf Config) (*FileStore, error) {
 	st, err := newFileStore(conf)
 	if err != nil {
 		return nil, err
 	}
+	if len(conf.Path) > 0 {
+		st.lock, err = lockDir(conf.Path)
+		if err != nil {
+			st.root.Close()
+			return nil, err
+		}
+	}
 	err = st.restore()
 	if err != nil {
+		st.close()
 		return nil, err
 	}
 	return st, nil
@@ -74,12 +175,93 @@ type FileStore struct {
 	fs   afero.Fs
 	conf Config
 
+	// root is a directory from config. It holds files that are shared by all generations.
+	root *Dir
+	// lock prevents other stores from using the same directory
+	lock *dirLock
+
+	generation *watermark
+	// all versions up to and including pruned are not readable
+	pruned *watermark
+
+	// gen is the generation of the tree, value and version files in dir
+	gen uint64
 	dir *Dir
 
 	trees, values *filesGroup
-	// TODO keep only last N (10000?) versions in a file
 	versionOffset *Offset
 	versions      *file
+	// pendingVersions are version records that are not written yet
+	pendingVersions []byte
+	commits         *file
+	// meta has a record for every version, see meta.go
+	meta        *file
+	pendingMeta []byte
+	nextMeta    metaRecord
+	// roots is the index of versions by the root hash, see roots.go
+	roots *rootIndex
+	// relaxed is the number of commits since the last durable one
+	relaxed  int
+	lastSync time.Time
+	// treeSum and valueSum are checksums of the bytes written since the last commit record
+	treeSum, valueSum uint32
+
+	recovery Recovery
+
+	// cache for decoded tree nodes, shared by every tree that uses this store
+	cache *cache
+	// pinned nodes are not written yet, they are never evicted
+	pinned *pinned
+	// aead encrypts values, nil if encryption is disabled
+	aead cipher.AEAD
+	// dedup is the index of the values in the current generation, nil if deduplication is disabled
+	dedup *dedupIndex
+	// oplog is shared by all generations, nil if it is disabled
+	oplog *opLog
+
+	// metrics are shared with the next generation
+	metrics *storeMetrics
+}
+
+// openGeneration opens directory for the generation and initializes empty file groups.
+// Files are assigned as they are opened, on error they are closed by closeGeneration.
+func (s *FileStore) openGeneration(gen uint64) error {
+	open := OpenDir
+	if s.conf.ReadOnly {
+		open = openReadOnlyDir
+	}
+	dir, err := open(s.fs, s.generationPath(gen))
+	if err != nil {
+		return err
+	}
+	dir.datasync = s.conf.Durability == DurabilityFdatasync
+	s.gen = gen
+	s.dir = dir
+	s.versionOffset = &Offset{maxFileSize: versionFileSize}
+	s.versions = nil
+	s.commits, err = dir.Open(commitPrefix, 0)
+	if err != nil {
+		return err
+	}
+	s.meta, err = dir.Open(metaPrefix, 0)
+	if err != nil {
+		return err
+	}
+	if !s.conf.ReadOnly {
+		s.roots, err = openRootIndex(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if s.conf.DedupIndexSize > 0 {
+		s.dedup = newDedupIndex(s.conf.DedupIndexSize)
+	}
+	s.trees = newGroup(treePrefix, dir, s.conf.MaxFileSize, s.conf.TreeWriteBuffer,
+		s.conf.ReadBufferChunkSize, s.conf.ReadBufferChunks, s.conf.MmapTrees)
+	// don't use read buffer for values
+	s.values = newGroup(valuePrefix, dir, s.conf.MaxFileSize, s.conf.ValueWriteBuffer,
+		0, 0, s.conf.MmapValues)
+	return nil
 }
 
 func (s *FileStore) getVersionFile() (*file, error) {
@@ -103,32 +285,126 @@ func (s *FileStore) ValueOffsetFor(size int) (uint32, uint32) {
 }
 
 func (s *FileStore) WriteValue(buf []byte) (int, error) {
-	return s.values.Write(buf)
+	n, err := s.values.Write(buf)
+	s.valueSum = crc32.Update(s.valueSum, crcTable, buf[:n])
+	s.metrics.valueWritten.Add(uint64(n))
+	return n, err
 }
 
 func (s *FileStore) WriteTree(buf []byte) (int, error) {
-	return s.trees.Write(buf)
+	n, err := s.trees.Write(buf)
+	s.treeSum = crc32.Update(s.treeSum, crcTable, buf[:n])
+	s.metrics.treeWritten.Add(uint64(n))
+	return n, err
 }
 
 func (s *FileStore) ReadTreeAt(index, off uint32, buf []byte) (int, error) {
+	defer s.metrics.treeReads.Since(time.Now())
 	return s.trees.ReadAt(buf, index, off)
 }
 
+// CachedNode returns decoded tree node from the position, if it is pinned or cached.
+// Returned node is shared and must not be modified.
+func (s *FileStore) CachedNode(index, off uint32) (interface{}, bool) {
+	if node, exist := s.pinned.Get(index, off); exist {
+		return node, true
+	}
+	if s.cache == nil {
+		return nil, false
+	}
+	return s.cache.Get(index, off)
+}
+
+// CacheNode adds decoded tree node from the position to the cache.
+// Size is an approximate amount of memory used by the node.
+func (s *FileStore) CacheNode(index, off uint32, node interface{}, size int) {
+	if s.cache == nil {
+		return
+	}
+	s.cache.Add(index, off, node, size)
+}
+
+// ViewTreeAt calls f with size bytes from the tree file. Slice may point to the memory mapped file,
+// it must not be modified or retained after f returns.
+func (s *FileStore) ViewTreeAt(index, off uint32, size int, f func([]byte) error) error {
+	defer s.metrics.treeReads.Since(time.Now())
+	return s.trees.View(index, off, size, f)
+}
+
 func (s *FileStore) ReadValueAt(index, off uint32, buf []byte) (int, error) {
+	defer s.metrics.valueReads.Since(time.Now())
 	return s.values.ReadAt(buf, index, off)
 }
 
+// InlineValueSize returns the inline limit from the config.
+func (s *FileStore) InlineValueSize() int {
+	return s.conf.InlineValueSize
+}
+
+// ValueChunkSize returns the chunk size from the config.
+func (s *FileStore) ValueChunkSize() int {
+	size := s.conf.ValueChunkSize
+	if size == 0 {
+		size = defaultValueChunkSize
+	}
+	if limit := int(s.conf.MaxFileSize / 2); size > limit {
+		return limit
+	}
+	return size
+}
+
+// ConcurrentWrites returns true, tree and value groups use separate files and buffers.
+func (s *FileStore) ConcurrentWrites() bool {
+	return true
+}
+
+// ValueCodec returns codec from the config.
+func (s *FileStore) ValueCodec() Codec {
+	return s.conf.ValueCodec
+}
+
+// WriteVersion adds version record to the store. Records are written to the version file on Commit,
+// after tree and value groups are durable, or on Flush.
 func (s *FileStore) WriteVersion(buf []byte) (int, error) {
-	s.versionOffset.OffsetFor(len(buf))
+	s.addMeta()
+	s.pendingVersions = append(s.pendingVersions, buf...)
+	return len(buf), nil
+}
+
+// writeVersions writes pending version records to the version file.
+func (s *FileStore) writeVersions() error {
+	if err := s.writeMeta(); err != nil {
+		return err
+	}
+	if len(s.pendingVersions) == 0 {
+		return nil
+	}
 	f, err := s.getVersionFile()
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return f.Write(buf)
+	n, err := f.Write(s.pendingVersions)
+	s.metrics.versionWritten.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+	if n != len(s.pendingVersions) {
+		return errors.New("incomplete version write")
+	}
+	if err := s.indexVersions(s.pendingVersions, s.versionOffset.Size()/versionRecordSize+1); err != nil {
+		return err
+	}
+	s.versionOffset.OffsetFor(n)
+	s.pendingVersions = s.pendingVersions[:0]
+	return nil
 }
 
+// ReadLastVersion reads the last version record into buf. Nothing is read if there are no versions.
 func (s *FileStore) ReadLastVersion(buf []byte) (int, error) {
 	_, off := s.versionOffset.Offset()
+	if int(off) < len(buf) {
+		return 0, nil
+	}
 	f, err := s.getVersionFile()
 	if err != nil {
 		return 0, err
@@ -140,6 +416,9 @@ func (s *FileStore) ReadVersion(version uint64, buf []byte) (int, error) {
 	if version == 0 {
 		return 0, errors.New("version 0 not found")
 	}
+	if err := s.checkPruned(version); err != nil {
+		return 0, err
+	}
 	off := (version - 1) * uint64(len(buf))
 	f, err := s.getVersionFile()
 	if err != nil {
@@ -148,58 +427,168 @@ func (s *FileStore) ReadVersion(version uint64, buf []byte) (int, error) {
 	return f.ReadAt(buf, int64(off))
 }
 
+// Commit makes written data and version records durable according to the durability level from the config.
+// Tree and value groups are synced before version records, see Sync.
 func (s *FileStore) Commit() error {
-	err := s.dir.Commit()
-	if err != nil {
-		return err
+	if s.conf.ReadOnly {
+		return ErrReadOnly
 	}
-	if err := s.trees.Commit(); err != nil {
-		return err
+	defer s.metrics.commits.Since(time.Now())
+	if !s.syncDue() {
+		return s.commitRelaxed()
 	}
-	if err := s.values.Commit(); err != nil {
-		return err
+	return s.Sync()
+}
+
+// syncGroups fsyncs the directory with the meta file, tree and value groups concurrently.
+func (s *FileStore) syncGroups() error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 3)
+	)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if errs[0] = s.dir.Commit(); errs[0] == nil {
+			errs[0] = s.meta.Commit()
+		}
+		if errs[0] == nil {
+			errs[0] = s.pruned.Sync()
+		}
+	}()
+	for i, group := range []struct {
+		fg    *filesGroup
+		timer *Timer
+	}{
+		{s.trees, &s.metrics.treeFsync},
+		{s.values, &s.metrics.valueFsync},
+	} {
+		go func(i int, fg *filesGroup, timer *Timer) {
+			defer wg.Done()
+			start := time.Now()
+			if errs[i] = fg.Commit(); errs[i] == nil {
+				timer.Since(start)
+			}
+		}(i+1, group.fg, group.timer)
 	}
-	f, err := s.getVersionFile()
-	if err != nil {
-		return err
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
-	return f.Commit()
+	return nil
 }
 
 func (s *FileStore) Flush() error {
+	if s.conf.ReadOnly {
+		return ErrReadOnly
+	}
 	if err := s.trees.Flush(); err != nil {
 		return err
 	}
 	if err := s.values.Flush(); err != nil {
 		return err
 	}
-	return nil
+	return s.writeVersions()
 }
 
+// Close makes relaxed commits durable, unless durability is DurabilityNone, and closes all files.
+// Files are closed and the lock is released even if sync fails, the first error is returned.
 func (s *FileStore) Close() error {
-	if err := s.trees.Close(); err != nil {
-		return err
+	var err error
+	if s.relaxed > 0 && s.conf.Durability != DurabilityNone {
+		err = s.Sync()
+	} else if !s.conf.ReadOnly && s.conf.Durability != DurabilityNone {
+		// versions may be pruned after the last commit
+		err = s.pruned.Sync()
 	}
-	if err := s.values.Close(); err != nil {
-		return err
+	return firstError(err, s.close())
+}
+
+// close closes every file that was opened and releases the lock. Store may be partially opened,
+// e.g. if restore failed.
+func (s *FileStore) close() error {
+	var errs []error
+	if s.dir != nil {
+		errs = append(errs, s.closeGeneration())
 	}
-	if s.versions != nil {
-		err := s.versions.Close()
-		if err != nil {
-			return err
+	if s.generation != nil {
+		errs = append(errs, s.generation.Close())
+	}
+	if s.pruned != nil {
+		errs = append(errs, s.pruned.Close())
+	}
+	if s.oplog != nil {
+		errs = append(errs, s.oplog.Close())
+	}
+	errs = append(errs, s.root.Close())
+	if s.lock != nil {
+		errs = append(errs, s.lock.Release())
+	}
+	return firstError(errs...)
+}
+
+// closeGeneration closes files of the generation, files that were not opened are skipped.
+func (s *FileStore) closeGeneration() error {
+	var errs []error
+	for _, fg := range []*filesGroup{s.trees, s.values} {
+		if fg != nil {
+			errs = append(errs, fg.Close())
 		}
 	}
-	return s.dir.Close()
+	for _, f := range []*file{s.versions, s.commits, s.meta} {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+	if s.roots != nil {
+		errs = append(errs, s.roots.close())
+	}
+	errs = append(errs, s.dir.Close())
+	return firstError(errs...)
 }
 
 func (s *FileStore) ReadStats(stats *Stats) {
 	s.trees.ReadStats(&stats.Tree)
 	s.values.ReadStats(&stats.Value)
+	if s.cache != nil {
+		s.cache.ReadStats(&stats.Tree)
+	}
 	stats.DiskSize = stats.Tree.DiskSize + stats.Value.DiskSize + s.versionOffset.Size()
 }
 
+// DiskUsage returns the space allocated in the tree and value groups of the current generation.
+func (s *FileStore) DiskUsage() (tree, value uint64) {
+	return s.trees.offset.Size(), s.values.offset.Size()
+}
+
 func (s *FileStore) restore() error {
-	err := s.trees.restore()
+	generation, err := openWatermark(s.root, generationPrefix)
+	if err != nil {
+		return err
+	}
+	s.generation = generation
+	pruned, err := openWatermark(s.root, prunePrefix)
+	if err != nil {
+		return err
+	}
+	s.pruned = pruned
+	if s.conf.OpLog && !s.conf.ReadOnly {
+		s.oplog, err = openOpLog(s.root)
+		if err != nil {
+			return err
+		}
+	}
+	if !s.conf.ReadOnly {
+		if err := s.removeStaleGenerations(); err != nil {
+			return err
+		}
+	}
+	if err := s.openGeneration(s.generation.Load()); err != nil {
+		return err
+	}
+	err = s.trees.restore()
 	if err != nil {
 		return err
 	}
@@ -211,10 +600,23 @@ func (s *FileStore) restore() error {
 	if err != nil {
 		return err
 	}
+	s.versions = f
 	size, err := f.Size()
 	if err != nil {
 		return err
 	}
-	s.versionOffset = newOffset(0, uint32(size), s.conf.MaxFileSize)
-	return nil
+	s.versionOffset = newOffset(0, uint32(size), versionFileSize)
+	if err := s.recover(); err != nil {
+		return err
+	}
+	if err := s.restorePruned(); err != nil {
+		return err
+	}
+	if s.conf.ReadOnly {
+		return nil
+	}
+	if err := s.restoreMeta(); err != nil {
+		return err
+	}
+	return s.indexRoots()
 }
@@ -0,0 +1,16 @@
+package store
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+func fdatasync(fd afero.File) error {
+	f, ok := fd.(*os.File)
+	if !ok {
+		return fd.Sync()
+	}
+	return syscall.Fdatasync(int(f.Fd()))
+}
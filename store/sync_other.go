@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package store
+
+import "github.com/spf13/afero"
+
+func fdatasync(fd afero.File) error {
+	return fd.Sync()
+}
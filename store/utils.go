@@ -1,5 +1,10 @@
 package store
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
 func newOffset(index, offset, fileSize uint32) *Offset {
 	return &Offset{
 		index:       index,
@@ -36,6 +41,7 @@ func (o *Offset) Size() uint64 {
 type GroupStats struct {
 	DiskSize              uint64
 	CacheHit, CacheMiss   uint64
+	BufferHit, BufferMiss uint64
 	FlushSize, FlushCount uint64
 	MeanFlushSize         uint64
 	FlushUtilization      float64 // mean flush size / buffer size
@@ -45,3 +51,26 @@ type Stats struct {
 	Tree, Value GroupStats
 	DiskSize    uint64
 }
+
+var (
+	order    = binary.BigEndian
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func putCrcSum32(crc []byte, buf []byte) {
+	order.PutUint32(crc, crcSum32(buf))
+}
+
+func crcSum32(buf []byte) uint32 {
+	return crc32.Update(0, crcTable, buf)
+}
+
+// firstError returns the first error that is not nil.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// value, crc
+const watermarkRecordSize = 8 + 4
+
+// openWatermark loads the last valid record from the file with the given prefix.
+func openWatermark(dir *Dir, prefix string) (*watermark, error) {
+	f, err := dir.Open(prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	w := &watermark{f: f}
+	if err := w.restore(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// watermark is an uint64 persisted as a sequence of checksummed records, the last valid record wins.
+// Torn record at the end of the file is ignored.
+type watermark struct {
+	f     *file
+	value uint64
+}
+
+func (w *watermark) Load() uint64 {
+	return atomic.LoadUint64(&w.value)
+}
+
+// Store appends record to the file and fsyncs it.
+func (w *watermark) Store(value uint64) error {
+	if err := w.Set(value); err != nil {
+		return err
+	}
+	return w.Sync()
+}
+
+// Set appends record to the file without fsync, it becomes durable with the next Sync.
+func (w *watermark) Set(value uint64) error {
+	buf := make([]byte, watermarkRecordSize)
+	order.PutUint64(buf, value)
+	putCrcSum32(buf[8:], buf[:8])
+	n, err := w.f.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("incomplete watermark write")
+	}
+	atomic.StoreUint64(&w.value, value)
+	return nil
+}
+
+// Sync fsyncs records appended by Set, if there are any.
+func (w *watermark) Sync() error {
+	return w.f.Commit()
+}
+
+func (w *watermark) Close() error {
+	return w.f.Close()
+}
+
+func (w *watermark) restore() error {
+	size, err := w.f.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, watermarkRecordSize)
+	for off := size - size%watermarkRecordSize - watermarkRecordSize; off >= 0; off -= watermarkRecordSize {
+		if _, err := w.f.ReadAt(buf, off); err != nil {
+			return err
+		}
+		if crcSum32(buf[:8]) == order.Uint32(buf[8:]) {
+			w.value = order.Uint64(buf)
+			return nil
+		}
+	}
+	return nil
+}
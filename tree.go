@@ -3,8 +3,10 @@ package urkeltrie
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"sync"
+	"time"
 
 	"github.com/dshulyak/urkeltrie/store"
 )
@@ -19,7 +21,7 @@ const (
 	leafSize     = 32 + 4 + 4 + 4 + 4 + 4   // key (hash), value idx, value pos, key length, value length, crc
 	innerSize    = 2 + 2*4 + 2*4 + 2*32 + 4 // node type x 2, leaf idx x 2, leaf pos x 2, leaf hashses x 2, crc
 	versionSize  = 8 + 4 + 4 + 32 + 4       // version, idx, pos, hash, crc
-	maxValueSize = int(^uint32(0))
+	maxValueSize = int(^uint32(0))          // larger values are stored in chunks
 )
 
 var (
@@ -27,7 +29,6 @@ var (
 	order            = binary.BigEndian
 
 	digestPool = sync.Pool{New: func() interface{} { return hasher() }}
-	innerPool  = sync.Pool{New: func() interface{} { return make([]byte, innerSize) }}
 	// results used for async hash computation
 	results = sync.Pool{New: func() interface{} { return make(chan []byte, 1) }}
 
@@ -42,15 +43,33 @@ func init() {
 	h.Sum(tmp)
 }
 
-func NewTree(store *store.FileStore) *Tree {
-	return &Tree{store: store}
+// NewTree creates a tree on top of the backend, usually *store.FileStore.
+// Operations are logged if the backend has an operation log, see LoadLatest.
+func NewTree(backend store.Backend) *Tree {
+	return &Tree{
+		store:   backend,
+		metrics: &treeMetrics{},
+		commits: &commitQueue{},
+		oplog:   store.OperationLog(backend),
+	}
 }
 
 type Tree struct {
-	store *store.FileStore
+	store store.Backend
 
 	version uint64
 	root    *inner
+
+	// metrics are shared with snapshots
+	metrics *treeMetrics
+	// commits are asynchronous commits that are not finished yet, see async.go
+	commits *commitQueue
+
+	// oplog is nil for snapshots and if the backend doesn't log operations, see oplog.go
+	oplog store.OpLog
+	opbuf []byte
+	// replayed is true after operations from the log were applied to the tree
+	replayed bool
 }
 
 func (t *Tree) Iterate(iterf IterateFunc) error {
@@ -77,6 +96,7 @@ func (t *Tree) GetRaw(key [size]byte) ([]byte, error) {
 	if t.root == nil {
 		return nil, errors.New("not found")
 	}
+	defer t.metrics.reads.Since(time.Now())
 	return t.root.Get(t.store, key)
 }
 
@@ -84,11 +104,31 @@ func (t *Tree) Version() uint64 {
 	return t.version
 }
 
+// DurableVersion returns the latest version that is known to be durable, it may be lower than Version
+// if the store doesn't fsync on every commit or if asynchronous commits are not finished.
+// If backend doesn't implement store.DurabilityReporter every committed version is considered durable.
+func (t *Tree) DurableVersion() uint64 {
+	if r, ok := t.store.(store.DurabilityReporter); ok {
+		return r.DurableVersion()
+	}
+	return t.version
+}
+
 func (t *Tree) Put(key, value []byte) error {
 	return t.PutRaw(sum(key), key, value)
 }
 
 func (t *Tree) PutRaw(key [size]byte, preimage, value []byte) error {
+	if err := t.put(key, preimage, value); err != nil {
+		return err
+	}
+	return t.logPut(key, preimage, value)
+}
+
+func (t *Tree) put(key [size]byte, preimage, value []byte) error {
+	if err := checkValueSize(t.store, value); err != nil {
+		return err
+	}
 	if t.root == nil {
 		t.root = newInner(0)
 	}
@@ -101,11 +141,20 @@ func (t *Tree) Delete(key []byte) error {
 }
 
 func (t *Tree) DeleteRaw(key [size]byte) error {
+	changed, err := t.delete(key)
+	if err != nil || !changed {
+		return err
+	}
+	return t.logDelete(key)
+}
+
+// delete removes the key from the tree and returns true if it was found.
+func (t *Tree) delete(key [size]byte) (bool, error) {
 	if t.root == nil {
-		return nil
+		return false, nil
 	}
-	_, _, err := t.root.Delete(t.store, key)
-	return err
+	_, changed, err := t.root.Delete(t.store, key)
+	return changed, err
 }
 
 func (t *Tree) Hash() []byte {
@@ -117,50 +166,168 @@ func (t *Tree) Hash() []byte {
 
 // Commit persists tree on disk and removes from memory.
 func (t *Tree) Commit() error {
+	return t.commit(nil)
+}
+
+// CommitWithMeta commits the tree and stores metadata together with the new version, e.g. height and hash
+// of the block. Metadata is returned by VersionMeta. Backend must implement store.VersionMetaStore.
+func (t *Tree) CommitWithMeta(meta []byte) error {
+	if _, ok := t.store.(store.VersionMetaStore); !ok {
+		return fmt.Errorf("backend %T doesn't support version metadata", t.store)
+	}
+	return t.commit(meta)
+}
+
+func (t *Tree) commit(meta []byte) error {
 	if t.root == nil {
 		return nil
 	}
+	if err := t.waitCommits(); err != nil {
+		return err
+	}
+	defer t.metrics.commits.Since(time.Now())
+	if err := t.write(); err != nil {
+		return err
+	}
+	return t.commitVersion(meta)
+}
+
+// write allocates and writes dirty nodes to the store.
+func (t *Tree) write() error {
+	nodes := countDirty(t.root)
 	t.root.Allocate(t.store)
-	err := t.root.Commit(t.store)
-	if err != nil {
+	if err := t.root.Commit(t.store); err != nil {
 		return err
 	}
+	t.metrics.written.Add(nodes)
+	t.metrics.lastWritten.Set(nodes)
+	return nil
+}
+
+// commitVersion writes version record and metadata for the root that was written to the store and makes them durable.
+func (t *Tree) commitVersion(meta []byte) error {
 	t.version++
+	if err := writeVersion(t.store, t.version, t.root, meta); err != nil {
+		return err
+	}
+	t.root = t.root.copy()
+	if err := pruneRetained(t.store, t.version); err != nil {
+		return err
+	}
+	return t.committedOps()
+}
+
+// writeVersion writes version record for the root and makes everything that was written durable.
+// Metadata is written only if it is not empty.
+func writeVersion(s store.Backend, version uint64, root *inner, meta []byte) error {
+	if len(meta) > 0 {
+		if err := s.(store.VersionMetaStore).WriteVersionMeta(meta); err != nil {
+			return err
+		}
+	}
 	buf := make([]byte, versionSize)
-	marshalVersionTo(t.version, t.root, buf)
-	n, err := t.store.WriteVersion(buf)
+	marshalVersionTo(version, root, buf)
+	n, err := s.WriteVersion(buf)
 	if err != nil {
 		return err
 	}
 	if n != len(buf) {
 		return errors.New("incomplete version write")
 	}
-	err = t.store.Commit()
-	if err != nil {
+	return s.Commit()
+}
+
+// pruneRetained prunes versions according to the retention policy of the store. Versions are retained
+// from the latest durable version, so that pruned versions are never ahead of the versions recovered after crash.
+func pruneRetained(s store.Backend, version uint64) error {
+	p, ok := s.(store.Pruner)
+	if !ok {
+		return nil
+	}
+	if r, ok := s.(store.DurabilityReporter); ok && r.DurableVersion() < version {
+		version = r.DurableVersion()
+	}
+	return p.PruneVersions(p.RetentionLimit(version))
+}
+
+// PruneVersions makes all versions up to and including upTo unreadable.
+// Loading pruned version will fail with store.ErrPruned. Pruning becomes durable with the next durable commit or close.
+func (t *Tree) PruneVersions(upTo uint64) error {
+	if upTo >= t.version {
+		return fmt.Errorf("can't prune version %d, current version is %d", upTo, t.version)
+	}
+	if err := t.waitCommits(); err != nil {
 		return err
 	}
-	t.root = t.root.copy()
-	return nil
+	p, ok := t.store.(store.Pruner)
+	if !ok {
+		return fmt.Errorf("backend %T doesn't support pruning", t.store)
+	}
+	return p.PruneVersions(upTo)
+}
+
+// VersionMeta returns metadata that was committed with the version, nil if version doesn't have metadata.
+func (t *Tree) VersionMeta(version uint64) ([]byte, error) {
+	if err := t.waitCommits(); err != nil {
+		return nil, err
+	}
+	m, ok := t.store.(store.VersionMetaStore)
+	if !ok {
+		return nil, fmt.Errorf("backend %T doesn't support version metadata", t.store)
+	}
+	return m.ReadVersionMeta(version)
+}
+
+// Rollback removes all versions after the version and loads it, the next commit creates version+1.
+// Dirty state and the operation log are discarded. If truncate is true tree nodes and values that were
+// written after the version are removed from the store, otherwise they remain until compaction.
+// Must not be called while compaction is running.
+func (t *Tree) Rollback(version uint64, truncate bool) error {
+	t.resetCommits()
+	r, ok := t.store.(store.Rollbacker)
+	if !ok {
+		return fmt.Errorf("backend %T doesn't support rollback", t.store)
+	}
+	if err := r.Rollback(version, truncate); err != nil {
+		return err
+	}
+	if version == 0 {
+		t.version, t.root = 0, nil
+		return t.loadedOps(false)
+	}
+	return t.LoadVersion(version)
 }
 
+// LoadLatest loads the latest committed version. If the backend has an operation log, operations that
+// were not committed before the tree was closed, e.g. because of a crash, are applied to the tree
+// after the first load, every following load discards them together with the dirty state.
+// Values that were written in chunks with PutReader are not logged.
 func (t *Tree) LoadLatest() error {
+	t.resetCommits()
 	buf := make([]byte, versionSize)
 	n, err := t.store.ReadLastVersion(buf)
 	if err != nil {
 		return err
 	}
-	if n != len(buf) {
+	switch {
+	case n == 0:
+		// store without versions
+		t.version, t.root = 0, nil
+	case n != len(buf):
 		return errors.New("incomplete version read")
+	default:
+		version, root, err := unmarshalVersion(t.store, buf)
+		if err != nil {
+			return err
+		}
+		t.version, t.root = version, root
 	}
-	version, root, err := unmarshalVersion(t.store, buf)
-	if err != nil {
-		return err
-	}
-	t.version, t.root = version, root
-	return nil
+	return t.loadedOps(true)
 }
 
+// LoadVersion loads the version, operations in the operation log are discarded.
 func (t *Tree) LoadVersion(version uint64) error {
+	t.resetCommits()
 	if version == 0 {
 		return nil
 	}
@@ -177,7 +344,7 @@ func (t *Tree) LoadVersion(version uint64) error {
 		return err
 	}
 	t.version, t.root = version, root
-	return nil
+	return t.loadedOps(false)
 }
 
 // Flush flushes tree to store buffers, potentially will be written to disk, but without fsync.
@@ -185,8 +352,10 @@ func (t *Tree) Flush() error {
 	if t.root == nil {
 		return nil
 	}
-	t.root.Allocate(t.store)
-	err := t.root.Commit(t.store)
+	if err := t.waitCommits(); err != nil {
+		return err
+	}
+	err := t.write()
 	if err != nil {
 		return err
 	}
@@ -218,13 +387,37 @@ func (t *Tree) Snapshot() Snapshot {
 		root:    t.root.copy(),
 		store:   t.store,
 		version: t.version,
+		metrics: t.metrics,
 	}
 }
 
 func (t *Tree) VersionSnapshot(version uint64) (Snapshot, error) {
-	tree := &Tree{store: t.store}
+	if err := t.waitCommits(); err != nil {
+		return nil, err
+	}
+	tree := &Tree{store: t.store, metrics: t.metrics}
 	if err := tree.LoadVersion(version); err != nil {
 		return nil, err
 	}
 	return tree, nil
 }
+
+// SnapshotByRoot returns snapshot of the latest version with the root hash, ErrNotFound if there is
+// no such version or it was pruned. Backend must implement store.RootIndex.
+func (t *Tree) SnapshotByRoot(hash []byte) (Snapshot, error) {
+	if err := t.waitCommits(); err != nil {
+		return nil, err
+	}
+	r, ok := t.store.(store.RootIndex)
+	if !ok {
+		return nil, fmt.Errorf("backend %T doesn't support lookup by root", t.store)
+	}
+	versions, err := r.VersionsByRoot(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: version with root %x", ErrNotFound, hash)
+	}
+	return t.VersionSnapshot(versions[len(versions)-1])
+}
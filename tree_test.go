@@ -2,11 +2,13 @@ package urkeltrie
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"sync"
@@ -94,6 +96,29 @@ func TestTreeGet(t *testing.T) {
 	}
 }
 
+func TestGetReturnsCopy(t *testing.T) {
+	tree := setupFullTree(t, 10)
+	key := []byte("key")
+	require.NoError(t, tree.Put(key, []byte("value")))
+	require.NoError(t, tree.Commit())
+	// leaf is loaded from the node cache, value of the cached record must not be modified
+	for i := 0; i < 2; i++ {
+		value, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+		value[0] = 'X'
+	}
+	require.NoError(t, tree.Iterate(func(e Entry) bool {
+		value, err := e.Value()
+		require.NoError(t, err)
+		value[0] = 'X'
+		return false
+	}))
+	value, err := tree.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
 func TestTreeCommitPersistent(t *testing.T) {
 	tree, closer := setupFullTreeP(t, 0)
 	defer closer()
@@ -504,9 +529,11 @@ func TestOpenExistingStore(t *testing.T) {
 		require.NoError(t, tree.Put(key, key))
 	}
 	require.NoError(t, tree.Commit())
+	require.NoError(t, st1.Close())
 
 	st2, err := store.Open(store.DefaultConfig(tmp))
 	require.NoError(t, err)
+	defer st2.Close()
 	tree = NewTree(st2)
 	require.NoError(t, tree.LoadLatest())
 
@@ -526,6 +553,49 @@ func TestOpenExistingStore(t *testing.T) {
 
 }
 
+func TestStoreLocked(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-store-lock-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	st1, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+
+	_, err = store.Open(store.DefaultConfig(tmp))
+	require.True(t, errors.Is(err, store.ErrLocked), "error: %v", err)
+
+	require.NoError(t, st1.Close())
+	st2, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	require.NoError(t, st2.Close())
+}
+
+func TestStoreFailedOpen(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-store-failed-open-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return 0
+		}
+		return len(fds)
+	}
+	before := openFiles()
+	// version file can't be opened
+	require.NoError(t, os.Mkdir(filepath.Join(tmp, "version-0.udb"), 0700))
+	_, err = store.Open(store.DefaultConfig(tmp))
+	require.Error(t, err)
+	require.Equal(t, before, openFiles())
+
+	require.NoError(t, os.Remove(filepath.Join(tmp, "version-0.udb")))
+	st, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+	require.Equal(t, before, openFiles())
+}
+
 func TestConsistentState(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping long test")
@@ -598,6 +668,814 @@ func TestConsistentState(t *testing.T) {
 	}
 }
 
+func commitRandomVersions(tb testing.TB, tree *Tree, versions int) [][]byte {
+	keys := [][]byte{}
+	for i := 0; i < versions; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		require.NoError(tb, tree.Put(key, key))
+		require.NoError(tb, tree.Commit())
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestPruneVersions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-prune-versions-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	st, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	tree := NewTree(st)
+	keys := commitRandomVersions(t, tree, 5)
+
+	require.Error(t, tree.PruneVersions(5))
+	require.NoError(t, tree.PruneVersions(3))
+
+	for version := uint64(1); version <= 3; version++ {
+		_, err := tree.VersionSnapshot(version)
+		require.True(t, errors.Is(err, store.ErrPruned), "error is %v", err)
+	}
+	snap, err := tree.VersionSnapshot(4)
+	require.NoError(t, err)
+	for _, key := range keys[:4] {
+		val, err := snap.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.True(t, errors.Is(tree.LoadVersion(3), store.ErrPruned))
+	require.NoError(t, tree.LoadVersion(4))
+}
+
+func TestRetentionWatermarkWrites(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-retention-watermark-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	commitRandomVersions(t, tree, 3)
+	require.NoError(t, st.Close())
+	path := filepath.Join(tmp, "prune-0.udb")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	// watermark is written only when the limit moves
+	conf.KeepNewerThan = 3
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	commitRandomVersions(t, tree, 5)
+	require.Equal(t, uint64(3), st.PrunedVersion())
+	require.NoError(t, st.Close())
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(8+4), info.Size())
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	conf := store.DefaultConfig("")
+	conf.KeepVersions = 2
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	commitRandomVersions(t, tree, 5)
+
+	require.Equal(t, uint64(3), st.PrunedVersion())
+	require.True(t, errors.Is(tree.LoadVersion(3), store.ErrPruned))
+	require.NoError(t, tree.LoadVersion(4))
+
+	conf = store.DefaultConfig("")
+	conf.KeepNewerThan = 2
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	commitRandomVersions(t, tree, 1)
+	require.Equal(t, uint64(0), st.PrunedVersion())
+	commitRandomVersions(t, tree, 4)
+	require.Equal(t, uint64(2), st.PrunedVersion())
+}
+
+func TestCheckpointRollback(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-checkpoint-rollback-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(filepath.Join(tmp, "store"))
+	conf.MaxFileSize = 4096
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree := NewTree(st)
+
+	keys := make([][]byte, 10)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 3)
+	hash := append([]byte{}, tree.Hash()...)
+	path := filepath.Join(tmp, "checkpoint")
+	require.NoError(t, st.Checkpoint(path))
+
+	// files that are hard linked by the checkpoint are truncated and overwritten
+	require.NoError(t, tree.Rollback(1, true))
+	commitOverwrites(t, tree, keys, 3)
+
+	cconf := conf
+	cconf.Path = path
+	report, err := Verify(cconf, 0, 0)
+	require.NoError(t, err)
+	require.True(t, report.OK(), "%v", report.Corrupted)
+
+	cst, err := store.Open(cconf)
+	require.NoError(t, err)
+	defer cst.Close()
+	require.False(t, cst.Recovery().Discarded())
+	ctree := NewTree(cst)
+	require.NoError(t, ctree.LoadLatest())
+	require.Equal(t, uint64(len(values)), ctree.Version())
+	require.Equal(t, hash, ctree.Hash())
+	for i, key := range keys {
+		val, err := ctree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[len(values)-1][i], val)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		truncate bool
+	}{
+		{"keep data", false},
+		{"truncate data", true},
+	} {
+		truncate := tc.truncate
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-rollback-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			conf.MaxFileSize = 1024
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			tree := NewTree(st)
+			var hashes [][]byte
+			keys := [][]byte{}
+			for i := 0; i < 10; i++ {
+				keys = append(keys, commitRandomVersions(t, tree, 1)...)
+				hashes = append(hashes, append([]byte{}, tree.Hash()...))
+			}
+			treeSize, valueSize := st.DiskUsage()
+
+			require.Error(t, tree.Rollback(11, truncate))
+			require.NoError(t, tree.Put([]byte("dirty"), []byte("dirty")))
+			require.NoError(t, tree.Rollback(5, truncate))
+			require.Equal(t, uint64(5), tree.Version())
+			require.Equal(t, hashes[4], tree.Hash())
+			rolledTree, rolledValue := st.DiskUsage()
+			if truncate {
+				require.Less(t, rolledTree, treeSize)
+				require.Less(t, rolledValue, valueSize)
+			} else {
+				require.Equal(t, treeSize, rolledTree)
+				require.Equal(t, valueSize, rolledValue)
+			}
+
+			keys = append(keys[:5], commitRandomVersions(t, tree, 1)...)
+			require.Equal(t, uint64(6), tree.Version())
+			hash := append([]byte{}, tree.Hash()...)
+			snap, err := tree.VersionSnapshot(6)
+			require.NoError(t, err)
+			require.Equal(t, hash, snap.Hash())
+			_, err = tree.VersionSnapshot(7)
+			require.Error(t, err)
+			require.NoError(t, st.Close())
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			defer st.Close()
+			require.False(t, st.Recovery().Discarded())
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.Equal(t, uint64(6), tree.Version())
+			require.Equal(t, hash, tree.Hash())
+			for _, key := range keys {
+				val, err := tree.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, key, val)
+			}
+
+			require.NoError(t, tree.Rollback(0, truncate))
+			require.Equal(t, uint64(0), tree.Version())
+			_, err = tree.Get(keys[0])
+			require.Error(t, err)
+			commitRandomVersions(t, tree, 1)
+			require.Equal(t, uint64(1), tree.Version())
+		})
+	}
+}
+
+func TestVersionMeta(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-version-meta-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 1024
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	metas := [][]byte{}
+	for i := 0; i < 10; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		require.NoError(t, tree.Put(key, key))
+		var meta []byte
+		if i%3 != 0 {
+			meta = make([]byte, 100)
+			rand.Read(meta)
+			require.NoError(t, tree.CommitWithMeta(meta))
+		} else {
+			require.NoError(t, tree.Commit())
+		}
+		metas = append(metas, meta)
+	}
+	check := func(tree *Tree, versions int) {
+		t.Helper()
+		for i, meta := range metas[:versions] {
+			rst, err := tree.VersionMeta(uint64(i + 1))
+			require.NoError(t, err)
+			require.Equal(t, meta, rst, "version %d", i+1)
+		}
+		_, err := tree.VersionMeta(uint64(versions + 1))
+		require.Error(t, err)
+	}
+	check(tree, 10)
+	require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+	check(tree, 10)
+	require.NoError(t, st.Close())
+
+	// meta records after the last intact version are discarded
+	truncateTail(t, filepath.Join(tmp, "gen-1", "version-0.udb"), versionSize)
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	check(tree, 9)
+
+	require.NoError(t, tree.Rollback(5, true))
+	check(tree, 5)
+	metas = append(metas[:5], []byte("meta"))
+	require.NoError(t, tree.CommitWithMeta(metas[5]))
+	check(tree, 6)
+}
+
+func TestSnapshotByRoot(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-snapshot-by-root-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 1 << 16
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	// enough versions to grow the index
+	keys := commitRandomVersions(t, tree, 600)
+	// versions without changes have the same root as version 600
+	require.NoError(t, tree.Commit())
+	require.NoError(t, tree.Commit())
+
+	hashes := [][]byte{}
+	for version := 1; version <= 602; version++ {
+		snap, err := tree.VersionSnapshot(uint64(version))
+		require.NoError(t, err)
+		hashes = append(hashes, snap.Hash())
+	}
+	require.Equal(t, hashes[599], hashes[601])
+	check := func(tree *Tree, versions int) {
+		t.Helper()
+		for i, hash := range hashes[:versions] {
+			expected := uint64(i + 1)
+			if i >= 599 && versions >= 602 {
+				expected = 602
+			}
+			snap, err := tree.SnapshotByRoot(hash)
+			require.NoError(t, err, "version %d", i+1)
+			require.Equal(t, expected, snap.Version())
+			require.Equal(t, hash, snap.Hash())
+		}
+		_, err := tree.SnapshotByRoot(zeros[:])
+		require.True(t, errors.Is(err, ErrNotFound), "error is %v", err)
+	}
+	check(tree, 602)
+	value, err := func() ([]byte, error) {
+		snap, err := tree.SnapshotByRoot(hashes[99])
+		if err != nil {
+			return nil, err
+		}
+		return snap.Get(keys[99])
+	}()
+	require.NoError(t, err)
+	require.Equal(t, keys[99], value)
+	require.NoError(t, st.Close())
+
+	reopen := func() {
+		t.Helper()
+		st, err = store.Open(conf)
+		require.NoError(t, err)
+		tree = NewTree(st)
+		require.NoError(t, tree.LoadLatest())
+	}
+	reopen()
+	check(tree, 602)
+	require.NoError(t, st.Close())
+
+	// index is rebuilt from the version file
+	names, err := filepath.Glob(filepath.Join(tmp, "roots-*.udb"))
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(tmp, "roots-1.udb")}, names)
+	for _, name := range names {
+		require.NoError(t, os.Remove(name))
+	}
+	reopen()
+	check(tree, 602)
+
+	// removed versions are not found
+	require.NoError(t, tree.Rollback(300, false))
+	_, err = tree.SnapshotByRoot(hashes[400])
+	require.True(t, errors.Is(err, ErrNotFound), "error is %v", err)
+	check(tree, 300)
+	commitRandomVersions(t, tree, 1)
+	snap, err := tree.SnapshotByRoot(tree.Hash())
+	require.NoError(t, err)
+	require.Equal(t, uint64(301), snap.Version())
+
+	require.NoError(t, tree.Compact(context.Background(), CompactionOptions{}))
+	check(tree, 300)
+	require.NoError(t, st.Close())
+	reopen()
+	defer st.Close()
+	check(tree, 300)
+}
+
+func TestNodeCache(t *testing.T) {
+	tree := setupFullTree(t, 0)
+	keys := [][]byte{}
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		require.NoError(t, tree.Put(key, key))
+		keys = append(keys, key)
+	}
+	require.NoError(t, tree.Commit())
+
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			val, err := tree.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, key, val)
+		}
+	}
+	var stats store.Stats
+	tree.store.(*store.FileStore).ReadStats(&stats)
+	require.NotZero(t, stats.Tree.CacheMiss)
+	require.Greater(t, stats.Tree.CacheHit, stats.Tree.CacheMiss)
+}
+
+func TestNodeCacheDisabled(t *testing.T) {
+	conf := store.DefaultConfig("")
+	conf.NodeCacheSize = 0
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	keys := commitRandomVersions(t, tree, 10)
+	for _, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+	var stats store.Stats
+	st.ReadStats(&stats)
+	require.Zero(t, stats.Tree.CacheHit)
+}
+
+func TestReadBuffer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-read-buffer-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.NodeCacheSize = 0
+	conf.ReadBufferChunkSize = 1 << 10
+	conf.ReadBufferChunks = 4
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree := NewTree(st)
+	for i := 0; i < 1000; i++ {
+		key := make([]byte, 10)
+		rand.Read(key)
+		require.NoError(t, tree.Put(key, key))
+	}
+	require.NoError(t, tree.Commit())
+
+	count := 0
+	require.NoError(t, tree.Iterate(func(e Entry) bool {
+		key, err := e.Key()
+		require.NoError(t, err)
+		val, err := e.Value()
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+		count++
+		return false
+	}))
+	require.Equal(t, 1000, count)
+
+	var stats store.Stats
+	st.ReadStats(&stats)
+	require.NotZero(t, stats.Tree.BufferMiss)
+	require.Greater(t, stats.Tree.BufferHit, stats.Tree.BufferMiss)
+	require.Zero(t, stats.Value.BufferHit)
+}
+
+func TestMmapSealedFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-mmap-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 4096
+	conf.TreeWriteBuffer = 4096
+	conf.ValueWriteBuffer = 4096
+	conf.NodeCacheSize = 0
+	conf.MmapTrees = true
+	conf.MmapValues = true
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 5)
+	check := func(tree *Tree) {
+		for version := range values {
+			snap, err := tree.VersionSnapshot(uint64(version + 1))
+			require.NoError(t, err)
+			for i, key := range keys {
+				val, err := snap.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, values[version][i], val)
+			}
+		}
+	}
+	check(tree)
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	check(tree)
+}
+
+func TestMmapViewDuringClose(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-mmap-view-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.MaxFileSize = 4096
+	conf.TreeWriteBuffer = 4096
+	conf.MmapTrees = true
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	commitRandomVersions(t, NewTree(st), 20)
+
+	expected := make([]byte, 1024)
+	_, err = st.ReadTreeAt(0, 0, expected)
+	require.NoError(t, err)
+	// mapping is unmapped after the view is released
+	require.NoError(t, st.ViewTreeAt(0, 0, len(expected), func(buf []byte) error {
+		require.NoError(t, st.Close())
+		require.Equal(t, expected, buf)
+		return nil
+	}))
+}
+
+func appendGarbage(tb testing.TB, path string, size int) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(tb, err)
+	defer f.Close()
+	buf := make([]byte, size)
+	rand.Read(buf)
+	_, err = f.Write(buf)
+	require.NoError(tb, err)
+}
+
+func truncateTail(tb testing.TB, path string, size int64) {
+	info, err := os.Stat(path)
+	require.NoError(tb, err)
+	require.NoError(tb, os.Truncate(path, info.Size()-size))
+}
+
+func TestRecoverTornWrites(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-recover-torn-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	st, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	require.False(t, st.Recovery().Discarded())
+	tree := NewTree(st)
+	keys := commitRandomVersions(t, tree, 3)
+	hash := tree.Hash()
+	require.NoError(t, st.Close())
+
+	appendGarbage(t, filepath.Join(tmp, "tree-0.udb"), 100)
+	appendGarbage(t, filepath.Join(tmp, "value-0.udb"), 33)
+	appendGarbage(t, filepath.Join(tmp, "version-0.udb"), 20)
+	appendGarbage(t, filepath.Join(tmp, "commit-0.udb"), 10)
+
+	st, err = store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	require.Equal(t, store.Recovery{
+		Version:      3,
+		TreeBytes:    100,
+		ValueBytes:   33,
+		VersionBytes: 20,
+		CommitBytes:  10,
+	}, st.Recovery())
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(3), tree.Version())
+	require.Equal(t, hash, tree.Hash())
+
+	keys = append(keys, commitRandomVersions(t, tree, 1)...)
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	defer st.Close()
+	require.False(t, st.Recovery().Discarded())
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(4), tree.Version())
+	for _, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+}
+
+func TestRecoverInterruptedCommit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-recover-interrupted-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	st, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	tree := NewTree(st)
+	keys := commitRandomVersions(t, tree, 3)
+	hash := append([]byte{}, tree.Hash()...)
+	commitRandomVersions(t, tree, 1)
+	require.NoError(t, st.Close())
+
+	// commit record for the last version wasn't written
+	truncateTail(t, filepath.Join(tmp, "commit-0.udb"), 28)
+
+	st, err = store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	defer st.Close()
+	recovery := st.Recovery()
+	require.Equal(t, uint64(3), recovery.Version)
+	require.Equal(t, uint64(versionSize), recovery.VersionBytes)
+	require.NotZero(t, recovery.TreeBytes)
+	require.NotZero(t, recovery.ValueBytes)
+
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, hash, tree.Hash())
+	for _, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+}
+
+func TestRecoverWithoutCommitRecords(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-recover-legacy-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	st, err := store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	tree := NewTree(st)
+	commitRandomVersions(t, tree, 3)
+	hash := tree.Hash()
+	require.NoError(t, st.Close())
+
+	require.NoError(t, os.Remove(filepath.Join(tmp, "commit-0.udb")))
+	appendGarbage(t, filepath.Join(tmp, "version-0.udb"), versionSize+10)
+
+	st, err = store.Open(store.DefaultConfig(tmp))
+	require.NoError(t, err)
+	defer st.Close()
+	require.Equal(t, store.Recovery{Version: 3, VersionBytes: versionSize + 10}, st.Recovery())
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, hash, tree.Hash())
+}
+
+func TestDurabilityModes(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		conf    func(*store.Config)
+		durable []uint64
+		closed  uint64
+	}{
+		{"fsync", func(*store.Config) {}, []uint64{1, 2, 3, 4, 5}, 5},
+		{"fdatasync", func(conf *store.Config) {
+			conf.Durability = store.DurabilityFdatasync
+		}, []uint64{1, 2, 3, 4, 5}, 5},
+		{"group", func(conf *store.Config) {
+			conf.Durability = store.DurabilityGroup
+			conf.SyncCommits = 2
+		}, []uint64{0, 2, 2, 4, 4}, 5},
+		{"group interval", func(conf *store.Config) {
+			conf.Durability = store.DurabilityGroup
+			conf.SyncInterval = time.Hour
+		}, []uint64{0, 0, 0, 0, 0}, 5},
+		{"none", func(conf *store.Config) {
+			conf.Durability = store.DurabilityNone
+		}, []uint64{0, 0, 0, 0, 0}, 0},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-durability-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			tc.conf(&conf)
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			tree := NewTree(st)
+			var keys [][]byte
+			for _, durable := range tc.durable {
+				keys = append(keys, commitRandomVersions(t, tree, 1)...)
+				require.Equal(t, durable, tree.DurableVersion())
+			}
+			hash := tree.Hash()
+			require.NoError(t, st.Close())
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			defer st.Close()
+			require.False(t, st.Recovery().Discarded())
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.Equal(t, uint64(len(tc.durable)), tree.Version())
+			require.Equal(t, tc.closed, tree.DurableVersion())
+			require.Equal(t, hash, tree.Hash())
+			for _, key := range keys {
+				val, err := tree.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, key, val)
+			}
+		})
+	}
+}
+
+func TestRecoverRelaxedCommits(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-recover-relaxed-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.Durability = store.DurabilityNone
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	keys := commitRandomVersions(t, tree, 2)
+	require.NoError(t, st.Sync())
+	require.Equal(t, uint64(2), tree.DurableVersion())
+	hash := append([]byte{}, tree.Hash()...)
+	commitRandomVersions(t, tree, 2)
+	require.Equal(t, uint64(2), tree.DurableVersion())
+	require.NoError(t, st.Close())
+
+	// writes of the relaxed commits were lost
+	truncateTail(t, filepath.Join(tmp, "version-0.udb"), 2*versionSize)
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	require.Equal(t, uint64(2), st.Recovery().Version)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(2), tree.Version())
+	require.Equal(t, uint64(2), tree.DurableVersion())
+	require.Equal(t, hash, tree.Hash())
+	for _, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+}
+
+func TestRecoverRelaxedPruned(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-recover-relaxed-pruned-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.Durability = store.DurabilityNone
+	conf.KeepVersions = 2
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	commitRandomVersions(t, tree, 8)
+	// versions are retained from the durable version
+	require.Zero(t, st.PrunedVersion())
+	require.NoError(t, st.Sync())
+	commitRandomVersions(t, tree, 1)
+	require.Equal(t, uint64(6), st.PrunedVersion())
+
+	commitRandomVersions(t, tree, 3)
+	require.NoError(t, tree.PruneVersions(10))
+	require.NoError(t, st.Close())
+
+	// relaxed commits were lost, but explicitly pruned watermark is on disk
+	truncateTail(t, filepath.Join(tmp, "version-0.udb"), 4*versionSize)
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	require.Equal(t, uint64(7), st.PrunedVersion())
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(8), tree.Version())
+	commitRandomVersions(t, tree, 1)
+	_, err = tree.VersionSnapshot(9)
+	require.NoError(t, err)
+}
+
+func TestRecoverRelaxedCorruptedData(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-recover-relaxed-corrupted-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	conf.Durability = store.DurabilityNone
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	commitRandomVersions(t, tree, 2)
+	require.NoError(t, st.Sync())
+	hash := append([]byte{}, tree.Hash()...)
+	treePath := filepath.Join(tmp, "tree-0.udb")
+	durable, err := os.Stat(treePath)
+	require.NoError(t, err)
+	commitRandomVersions(t, tree, 2)
+	require.NoError(t, st.Close())
+
+	// version records and roots of the relaxed commits are intact, but other nodes were not written
+	corruptFile(t, treePath, durable.Size(), func(data []byte) { data[0] ^= 0xff })
+
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	require.Equal(t, uint64(2), st.Recovery().Version)
+	require.NotZero(t, st.Recovery().TreeBytes)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(2), tree.Version())
+	require.Equal(t, hash, tree.Hash())
+	commitRandomVersions(t, tree, 1)
+	require.Equal(t, uint64(3), tree.Version())
+}
+
 func BenchmarkRandomRead500000(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
@@ -654,35 +1532,159 @@ func benchmarkCommitPersistent(b *testing.B, tree testTree, db *store.FileStore,
 func BenchmarkBlock100(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
-	benchmarkCommitPersistent(b, tree, tree.store, 100)
+	benchmarkCommitPersistent(b, tree, tree.store.(*store.FileStore), 100)
 }
 
 func BenchmarkBlock500(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
-	benchmarkCommitPersistent(b, tree, tree.store, 500)
+	benchmarkCommitPersistent(b, tree, tree.store.(*store.FileStore), 500)
 }
 
 func BenchmarkBlock1000(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
-	benchmarkCommitPersistent(b, tree, tree.store, 1000)
+	benchmarkCommitPersistent(b, tree, tree.store.(*store.FileStore), 1000)
 }
 
 func BenchmarkBlock5000(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
-	benchmarkCommitPersistent(b, tree, tree.store, 5000)
+	benchmarkCommitPersistent(b, tree, tree.store.(*store.FileStore), 5000)
 }
 
 func BenchmarkBlock10000(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
-	benchmarkCommitPersistent(b, tree, tree.store, 10000)
+	benchmarkCommitPersistent(b, tree, tree.store.(*store.FileStore), 10000)
 }
 
 func BenchmarkBlock40000(b *testing.B) {
 	tree, closer := setupProdTree(b)
 	defer closer()
-	benchmarkCommitPersistent(b, tree, tree.store, 40000)
+	benchmarkCommitPersistent(b, tree, tree.store.(*store.FileStore), 40000)
+}
+
+// countingBackend hides optional interfaces of the file store and counts tree reads and writes.
+// Writes are counted without synchronization, race detector reports if they are concurrent.
+type countingBackend struct {
+	store.Backend
+	treeReads int
+	writes    int
+}
+
+func (b *countingBackend) WriteTree(buf []byte) (int, error) {
+	b.writes++
+	return b.Backend.WriteTree(buf)
+}
+
+func (b *countingBackend) WriteValue(buf []byte) (int, error) {
+	b.writes++
+	return b.Backend.WriteValue(buf)
+}
+
+func (b *countingBackend) ReadTreeAt(index, off uint32, buf []byte) (int, error) {
+	b.treeReads++
+	return b.Backend.ReadTreeAt(index, off, buf)
+}
+
+func TestCustomBackend(t *testing.T) {
+	st, err := store.Open(store.DefaultConfig(""))
+	require.NoError(t, err)
+	defer st.Close()
+	backend := &countingBackend{Backend: st}
+	tree := NewTree(backend)
+
+	keys := commitRandomVersions(t, tree, 3)
+	hash := append([]byte{}, tree.Hash()...)
+
+	tree = NewTree(backend)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, hash, tree.Hash())
+	for _, key := range keys {
+		val, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+	require.NotZero(t, backend.treeReads)
+	require.NotZero(t, backend.writes)
+	require.Error(t, tree.PruneVersions(1))
+
+	_, err = tree.StartCompaction(CompactionOptions{})
+	require.Error(t, err)
+}
+
+func TestCheckpoint(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-checkpoint-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(filepath.Join(tmp, "store"))
+	conf.MaxFileSize = 4096
+	conf.TreeWriteBuffer = 4096
+	conf.ValueWriteBuffer = 4096
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	defer st.Close()
+	tree := NewTree(st)
+
+	keys := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	values := commitOverwrites(t, tree, keys, 8)
+	hash := append([]byte{}, tree.Hash()...)
+	require.NoError(t, tree.PruneVersions(5))
+
+	// commits concurrently with the checkpoint are not visible in it
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			commitOverwrites(t, tree, keys[:2], 1)
+		}
+	}()
+	path := filepath.Join(tmp, "checkpoint")
+	checkpoint := func() error {
+		defer func() {
+			close(stop)
+			wg.Wait()
+		}()
+		return st.Checkpoint(path)
+	}
+	require.NoError(t, checkpoint())
+	require.Error(t, st.Checkpoint(path))
+
+	linked, err := os.Stat(filepath.Join(path, "tree-0.udb"))
+	require.NoError(t, err)
+	original, err := os.Stat(filepath.Join(conf.Path, "tree-0.udb"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(linked, original))
+
+	conf.Path = path
+	cst, err := store.Open(conf)
+	require.NoError(t, err)
+	defer cst.Close()
+	require.False(t, cst.Recovery().Discarded())
+	require.Equal(t, uint64(5), cst.PrunedVersion())
+	ctree := NewTree(cst)
+	require.NoError(t, ctree.LoadLatest())
+	require.GreaterOrEqual(t, ctree.Version(), uint64(len(values)))
+	require.NoError(t, ctree.LoadVersion(uint64(len(values))))
+	require.Equal(t, hash, ctree.Hash())
+	for i, key := range keys {
+		val, err := ctree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[len(values)-1][i], val)
+	}
 }
@@ -23,14 +23,22 @@ func sum(key []byte) (rst [size]byte) {
 type node interface {
 	// TODO rework node visibility, majority of this methods shouldn't be visible outside module
 	isDirty() bool
-	Get(*store.FileStore, [size]byte) ([]byte, error)
+	Get(store.Backend, [size]byte) ([]byte, error)
 	Hash() []byte
-	Allocate(*store.FileStore)
+	Allocate(store.Backend)
 	Position() (uint32, uint32)
-	Commit(*store.FileStore) error
-	Prove(*store.FileStore, [size]byte, *Proof) error
-	Delete(*store.FileStore, [size]byte) (bool, bool, error)
-	Sync(*store.FileStore) error
+	Commit(store.Backend) error
+	Prove(store.Backend, [size]byte, *Proof) error
+	Delete(store.Backend, [size]byte) (bool, bool, error)
+	Sync(store.Backend) error
+}
+
+// copyBytes returns a copy of the slice, nil stays nil.
+func copyBytes(buf []byte) []byte {
+	if buf == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(buf)), buf...)
 }
 
 func putCrcSum32(crc []byte, buf []byte) {
@@ -50,7 +58,7 @@ func marshalVersionTo(version uint64, node *inner, buf []byte) {
 	putCrcSum32(buf[48:52], buf[:48])
 }
 
-func unmarshalVersion(store *store.FileStore, buf []byte) (uint64, *inner, error) {
+func unmarshalVersion(store store.Backend, buf []byte) (uint64, *inner, error) {
 	if crcSum32(buf[:48]) != order.Uint32(buf[48:]) {
 		return 0, nil, ErrCRC
 	}
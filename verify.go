@@ -0,0 +1,299 @@
+package urkeltrie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dshulyak/urkeltrie/store"
+)
+
+// ErrHashMismatch returned if the hash of the node doesn't match the hash stored by its parent.
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// Corruption describes a record that failed verification.
+type Corruption struct {
+	// Version is the first verified version that references the record.
+	Version uint64
+	// Index and Offset is the position of the record in the tree group.
+	// Both are zero if the version record is corrupted.
+	Index, Offset uint32
+	// Err wraps ErrCRC, ErrAuthentication or ErrHashMismatch, or describes why the record can't be read.
+	Err error
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf("version %d, record at %d:%d: %v", c.Version, c.Index, c.Offset, c.Err)
+}
+
+// VerifyReport is the result of the verification.
+type VerifyReport struct {
+	// From and To are the first and the last verified versions.
+	From, To uint64
+	// Pruned is the number of skipped versions that were pruned.
+	Pruned uint64
+	// Inner and Leaves are the number of checked records. Records shared by versions are counted once.
+	Inner, Leaves uint64
+
+	Corrupted []Corruption
+	// Affected are the versions that reference at least one corrupted record.
+	Affected []uint64
+
+	// ReachableBytes is the size of the records and value bodies reachable from the verified versions.
+	ReachableBytes uint64
+	// UnreachableBytes is the rest of the space in the tree and value groups. It can be reclaimed by
+	// compaction if every version that is not pruned was verified. Zero if backend doesn't report its usage.
+	UnreachableBytes uint64
+
+	// Recovery describes data that would be discarded when the store is opened for writes.
+	// Verify doesn't discard it.
+	Recovery store.Recovery
+}
+
+// OK returns true if no corruption was found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupted) == 0
+}
+
+// diskUsage is a backend that reports the space used by the tree and value groups.
+type diskUsage interface {
+	DiskUsage() (uint64, uint64)
+}
+
+// Verify opens the store read-only and verifies versions between from and to, see Tree.Verify.
+// Files are not modified, data after the last intact commit is reported in VerifyReport.Recovery.
+// Store is locked until verification is finished, therefore it can't be used by other process.
+func Verify(conf store.Config, from, to uint64) (*VerifyReport, error) {
+	conf.ReadOnly = true
+	st, err := store.Open(conf)
+	if err != nil {
+		return nil, err
+	}
+	report, err := NewTree(st).Verify(from, to)
+	if err != nil {
+		_ = st.Close()
+		return nil, err
+	}
+	report.Recovery = st.Recovery()
+	return report, st.Close()
+}
+
+// Verify reads every record reachable from the versions between from and to, inclusive, and checks
+// crc of the records and value bodies, and that the hash stored for every node matches the hash
+// recomputed from its content. Zero from or to selects the first or the last committed version.
+// Pruned versions are skipped.
+//
+// Corrupted records are collected in the report, error is returned only if the version file can't be read.
+// Records shared by versions are checked once, which requires to keep in memory ~50 bytes per record.
+// Verify reads only committed data and bypasses the node cache.
+func (t *Tree) Verify(from, to uint64) (*VerifyReport, error) {
+	if err := t.waitCommits(); err != nil {
+		return nil, err
+	}
+	last, err := t.lastVersion()
+	if err != nil {
+		return nil, err
+	}
+	if from == 0 {
+		from = 1
+	}
+	if to == 0 {
+		to = last
+	}
+	if to > last {
+		return nil, fmt.Errorf("version %d not found, last version is %d", to, last)
+	}
+	v := &verifier{
+		store:   t.store,
+		report:  &VerifyReport{From: from, To: to},
+		checked: map[uint64]checkedNode{},
+		values:  map[uint64]struct{}{},
+	}
+	buf := make([]byte, versionSize)
+	for version := from; version <= to; version++ {
+		if err := v.verifyVersion(version, buf); err != nil {
+			return nil, err
+		}
+	}
+	if du, ok := t.store.(diskUsage); ok {
+		tree, value := du.DiskUsage()
+		if total := tree + value; total > v.report.ReachableBytes {
+			v.report.UnreachableBytes = total - v.report.ReachableBytes
+		}
+	}
+	return v.report, nil
+}
+
+type checkedNode struct {
+	hash [size]byte
+	// hashed is false if the record can't be read
+	hashed, ok bool
+}
+
+type verifier struct {
+	store  store.Backend
+	report *VerifyReport
+
+	// checked maps position of the record to its hash and the result of the check of its subtree
+	checked map[uint64]checkedNode
+	// values are positions of the value bodies that were counted as reachable
+	values map[uint64]struct{}
+	// affected is true if the current version references corrupted record
+	affected bool
+}
+
+func (v *verifier) corrupted(version uint64, idx, pos uint32, err error) {
+	v.affected = true
+	v.report.Corrupted = append(v.report.Corrupted, Corruption{
+		Version: version,
+		Index:   idx,
+		Offset:  pos,
+		Err:     err,
+	})
+}
+
+func (v *verifier) verifyVersion(version uint64, buf []byte) error {
+	n, err := v.store.ReadVersion(version, buf)
+	if errors.Is(err, store.ErrPruned) {
+		v.report.Pruned++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("incomplete version read")
+	}
+	v.affected = false
+	recorded, root, err := unmarshalVersion(v.store, buf)
+	if err == nil && recorded != version {
+		err = fmt.Errorf("record has version %d", recorded)
+	}
+	if err != nil {
+		v.corrupted(version, 0, 0, fmt.Errorf("version record: %w", err))
+	} else {
+		hash, _ := v.verifyNode(version, innerNode, 0, root.idx, root.pos)
+		if hash != nil && !bytes.Equal(hash, root.hash) {
+			v.corrupted(version, root.idx, root.pos, fmt.Errorf("%w: root doesn't match version record", ErrHashMismatch))
+		}
+	}
+	if v.affected {
+		v.report.Affected = append(v.report.Affected, version)
+	}
+	return nil
+}
+
+// verifyNode checks the record and its subtree, and returns true if subtree is intact.
+// Hash of the record is returned if the record was read, even if its subtree is corrupted.
+func (v *verifier) verifyNode(version uint64, ntype byte, depth int, idx, pos uint32) ([]byte, bool) {
+	if checked, exist := v.checked[position(idx, pos)]; exist {
+		if !checked.ok {
+			v.affected = true
+		}
+		if !checked.hashed {
+			return nil, false
+		}
+		return checked.hash[:], checked.ok
+	}
+	var (
+		hash []byte
+		ok   bool
+		err  error
+	)
+	switch ntype {
+	case innerNode:
+		hash, ok, err = v.verifyInner(version, depth, idx, pos)
+	case leafNode, encodedLeafNode, inlineLeafNode, sharedLeafNode, chunkedLeafNode:
+		hash, err = v.verifyLeaf(ntype, idx, pos)
+		ok = err == nil
+	default:
+		err = fmt.Errorf("unknown node type %d", ntype)
+	}
+	if err != nil {
+		v.corrupted(version, idx, pos, err)
+	}
+	checked := checkedNode{hashed: hash != nil, ok: ok}
+	copy(checked.hash[:], hash)
+	v.checked[position(idx, pos)] = checked
+	return hash, ok
+}
+
+func (v *verifier) verifyInner(version uint64, depth int, idx, pos uint32) ([]byte, bool, error) {
+	if depth > lastBit {
+		return nil, false, fmt.Errorf("inner node is deeper than %d bits", lastBit+1)
+	}
+	in := createInner(uint8(depth), idx, pos, nil)
+	var record *innerRecord
+	err := store.ViewTree(v.store, idx, pos, in.Size(), func(buf []byte) (err error) {
+		record, err = in.decode(buf)
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed inner tree read at %d:%d. error %w", idx, pos, err)
+	}
+	v.report.Inner++
+	v.report.ReachableBytes += uint64(in.Size())
+
+	ok := true
+	for _, child := range []struct {
+		ntype    byte
+		idx, pos uint32
+		hash     [size]byte
+	}{
+		{record.ltype, record.leftIdx, record.leftPos, record.leftHash},
+		{record.rtype, record.rightIdx, record.rightPos, record.rightHash},
+	} {
+		if child.ntype == nullNode {
+			if child.hash != zerosHash {
+				v.corrupted(version, idx, pos, fmt.Errorf("%w: empty child with non-zero hash", ErrHashMismatch))
+				ok = false
+			}
+			continue
+		}
+		hash, intact := v.verifyNode(version, child.ntype, depth+1, child.idx, child.pos)
+		if !intact {
+			ok = false
+		}
+		// hash of the record is compared even if its subtree is corrupted
+		if hash != nil && !bytes.Equal(hash, child.hash[:]) {
+			v.corrupted(version, child.idx, child.pos,
+				fmt.Errorf("%w: parent at %d:%d stores a different hash", ErrHashMismatch, idx, pos))
+			ok = false
+		}
+	}
+	h := hasher()
+	h.Write([]byte{innerDomain})
+	h.Write(record.leftHash[:])
+	h.Write(record.rightHash[:])
+	return h.Sum(nil), ok, nil
+}
+
+func (v *verifier) verifyLeaf(ntype byte, idx, pos uint32) ([]byte, error) {
+	l := createLeaf(ntype, idx, pos, nil)
+	if err := l.read(v.store); err != nil {
+		return nil, err
+	}
+	v.report.Leaves++
+	v.report.ReachableBytes += uint64(l.Size())
+	switch ntype {
+	case inlineLeafNode:
+	case chunkedLeafNode:
+		for _, ref := range l.chunks {
+			v.report.ReachableBytes += uint64(ref.size) + 4
+		}
+		// chunks are read one by one and checked against the hash of the value
+		rst, err := l.hashChunks(v.store)
+		if err != nil {
+			return nil, err
+		}
+		return leafHash(l.key[:], rst), nil
+	default:
+		// shared body is counted once
+		value := position(l.valueIdx, l.valuePos)
+		if _, exist := v.values[value]; !exist {
+			v.values[value] = struct{}{}
+			v.report.ReachableBytes += uint64(l.bodySize) + 4
+		}
+	}
+	return l.Hash(), nil
+}
@@ -0,0 +1,209 @@
+package urkeltrie
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dshulyak/urkeltrie/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		conf func(*store.Config)
+	}{
+		{"plain", func(*store.Config) {}},
+		{"inline", func(conf *store.Config) {
+			conf.InlineValueSize = 256
+			conf.ValueCodec = store.Flate
+		}},
+		{"dedup encrypted", func(conf *store.Config) {
+			conf.DedupIndexSize = 1000
+			conf.EncryptionKey = make([]byte, 32)
+		}},
+	} {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testing-verify-")
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+			conf := store.DefaultConfig(tmp)
+			tc.conf(&conf)
+			st, err := store.Open(conf)
+			require.NoError(t, err)
+			tree := NewTree(st)
+			keys := make([][]byte, 50)
+			for i := range keys {
+				keys[i] = make([]byte, 10)
+				rand.Read(keys[i])
+			}
+			commitOverwrites(t, tree, keys, 2)
+			// identical values share the body
+			for _, key := range keys {
+				require.NoError(t, tree.Put(key, []byte("shared")))
+			}
+			require.NoError(t, tree.Commit())
+			require.NoError(t, st.Close())
+
+			report, err := Verify(conf, 0, 0)
+			require.NoError(t, err)
+			require.True(t, report.OK(), "%v", report.Corrupted)
+			require.Equal(t, uint64(1), report.From)
+			require.Equal(t, uint64(3), report.To)
+			require.Equal(t, uint64(3*len(keys)), report.Leaves)
+			require.Zero(t, report.UnreachableBytes)
+
+			st, err = store.Open(conf)
+			require.NoError(t, err)
+			tree = NewTree(st)
+			require.NoError(t, tree.LoadLatest())
+			require.NoError(t, tree.PruneVersions(1))
+			require.NoError(t, st.Close())
+
+			report, err = Verify(conf, 0, 0)
+			require.NoError(t, err)
+			require.True(t, report.OK(), "%v", report.Corrupted)
+			require.Equal(t, uint64(1), report.Pruned)
+			require.NotZero(t, report.UnreachableBytes)
+		})
+	}
+}
+
+func corruptFile(tb testing.TB, path string, off int64, corrupt func([]byte)) {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(tb, err)
+	corrupt(data[off:])
+	require.NoError(tb, ioutil.WriteFile(path, data, 0o644))
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-verify-corrupted-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = make([]byte, 10)
+		rand.Read(keys[i])
+	}
+	commitOverwrites(t, tree, keys, 4)
+	require.NoError(t, st.Close())
+
+	version := make([]byte, versionSize)
+	// body of the first value, it was overwritten in the second version
+	corruptFile(t, filepath.Join(tmp, "value-0.udb"), 0, func(buf []byte) {
+		buf[0] ^= 0xff
+	})
+	// record of the third version
+	corruptFile(t, filepath.Join(tmp, "version-0.udb"), 2*versionSize, func(buf []byte) {
+		buf[20] ^= 0xff
+	})
+	// left hash in the root of the second version, crc is updated so that only hash is wrong
+	corruptFile(t, filepath.Join(tmp, "version-0.udb"), versionSize, func(buf []byte) {
+		copy(version, buf)
+	})
+	rootPos := int64(order.Uint32(version[12:]))
+	var leftIdx, leftPos uint32
+	corruptFile(t, filepath.Join(tmp, "tree-0.udb"), rootPos, func(buf []byte) {
+		leftIdx, leftPos = order.Uint32(buf[2:]), order.Uint32(buf[6:])
+		buf[18] ^= 0xff
+		putCrcSum32(buf[82:], buf[:82])
+	})
+
+	report, err := Verify(conf, 0, 0)
+	require.NoError(t, err)
+	require.False(t, report.Recovery.Discarded())
+	require.False(t, report.OK())
+	require.Equal(t, []uint64{1, 2, 3}, report.Affected)
+	require.Len(t, report.Corrupted, 4)
+
+	var crc, mismatch []Corruption
+	for _, c := range report.Corrupted {
+		if errors.Is(c.Err, ErrCRC) {
+			crc = append(crc, c)
+		} else if errors.Is(c.Err, ErrHashMismatch) {
+			mismatch = append(mismatch, c)
+		}
+	}
+	require.Len(t, crc, 2)
+	require.Equal(t, uint64(1), crc[0].Version)
+	require.Equal(t, Corruption{Version: 3, Err: crc[1].Err}, crc[1])
+
+	require.Len(t, mismatch, 2)
+	require.Equal(t, uint64(2), mismatch[0].Version)
+	require.Equal(t, leftIdx, mismatch[0].Index)
+	require.Equal(t, leftPos, mismatch[0].Offset)
+	require.Equal(t, uint64(2), mismatch[1].Version)
+	require.Equal(t, uint32(rootPos), mismatch[1].Offset)
+
+	// only the last version is intact
+	report, err = Verify(conf, 4, 4)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+}
+
+func TestVerifyReadOnly(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testing-verify-read-only-")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(tmp)) }()
+
+	conf := store.DefaultConfig(tmp)
+	st, err := store.Open(conf)
+	require.NoError(t, err)
+	tree := NewTree(st)
+	commitRandomVersions(t, tree, 3)
+	require.NoError(t, st.Close())
+
+	expected := store.Recovery{Version: 3, TreeBytes: 100, ValueBytes: 50, VersionBytes: 10, CommitBytes: 5}
+	appendGarbage(t, filepath.Join(tmp, "tree-0.udb"), int(expected.TreeBytes))
+	appendGarbage(t, filepath.Join(tmp, "value-0.udb"), int(expected.ValueBytes))
+	appendGarbage(t, filepath.Join(tmp, "version-0.udb"), int(expected.VersionBytes))
+	appendGarbage(t, filepath.Join(tmp, "commit-0.udb"), int(expected.CommitBytes))
+	files := func() map[string][]byte {
+		rst := map[string][]byte{}
+		names, err := filepath.Glob(filepath.Join(tmp, "*.udb"))
+		require.NoError(t, err)
+		for _, name := range names {
+			data, err := ioutil.ReadFile(name)
+			require.NoError(t, err)
+			rst[name] = data
+		}
+		return rst
+	}
+	before := files()
+
+	report, err := Verify(conf, 0, 0)
+	require.NoError(t, err)
+	require.True(t, report.OK(), "%v", report.Corrupted)
+	require.Equal(t, uint64(3), report.To)
+	require.Equal(t, expected, report.Recovery)
+	require.Equal(t, before, files())
+
+	conf.ReadOnly = true
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	tree = NewTree(st)
+	require.NoError(t, tree.LoadLatest())
+	require.Equal(t, uint64(3), tree.Version())
+	require.NoError(t, tree.Put([]byte("key"), []byte("value")))
+	require.True(t, errors.Is(tree.Commit(), store.ErrReadOnly))
+	require.NoError(t, st.Close())
+	require.Equal(t, before, files())
+
+	// regular open discards the same data
+	conf.ReadOnly = false
+	st, err = store.Open(conf)
+	require.NoError(t, err)
+	require.Equal(t, expected, st.Recovery())
+	require.NoError(t, st.Close())
+}